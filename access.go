@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Access-lists.
+//
+// The server may be configured with lists of the networks which visitors
+// may, and may not, connect from.  Each tunnel may also announce its own
+// lists, for example to only accept requests from the addresses GitHub
+// sends its webhooks from, which the server enforces before the request
+// is published.
+//
+// A client may give its lists as addresses, CIDR ranges, or the paths to
+// files containing them, one per line.
+//
+
+// accessList holds the networks visitors may, and may not, connect from.
+type accessList struct {
+	// allow holds the networks visitors may connect from.  If it is
+	// empty all visitors who aren't denied are allowed.
+	allow []*net.IPNet
+
+	// deny holds the networks visitors may not connect from.
+	deny []*net.IPNet
+}
+
+// newAccessList creates an access-list from the given lists of networks.
+func newAccessList(allow []string, deny []string) (accessList, error) {
+	var a accessList
+	var err error
+	if a.allow, err = parseNetworks(allow); err != nil {
+		return a, err
+	}
+	if a.deny, err = parseNetworks(deny); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+// denyAll returns an access-list which denies every visitor.
+func denyAll() accessList {
+	return accessList{deny: []*net.IPNet{
+		{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+	}}
+}
+
+// permitted returns true if the visitor at the given address may make
+// requests.
+func (a accessList) permitted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// parseNetworks parses the given list of networks, which may be given
+// as either CIDR ranges or single addresses.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, ent := range list {
+		if !strings.Contains(ent, "/") {
+			ip := net.ParseIP(ent)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", ent)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(ent)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, network)
+	}
+	return out, nil
+}
+
+// containsIP returns true if any of the given networks contains the
+// given address.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandNetworks returns the given list of networks, replacing the paths
+// of any files with the networks they contain.
+//
+// Within a file blank lines, and comments beginning with "#", are
+// ignored.
+func expandNetworks(list []string) ([]string, error) {
+	var out []string
+	for _, ent := range list {
+		if _, err := parseNetworks([]string{ent}); err == nil {
+			out = append(out, ent)
+			continue
+		}
+
+		file, err := os.Open(ent)
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither a network nor a readable file: %s", ent, err.Error())
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			if _, err = parseNetworks([]string{line}); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s: %s", ent, err.Error())
+			}
+			out = append(out, line)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
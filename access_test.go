@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestNewAccessList tests that invalid networks are rejected.
+func TestNewAccessList(t *testing.T) {
+
+	tests := []struct {
+		allow []string
+		deny  []string
+		valid bool
+	}{
+		{nil, nil, true},
+		{[]string{"1.2.3.4", "10.0.0.0/8"}, []string{"::1", "2001:db8::/32"}, true},
+		{[]string{"1.2.3.4/33"}, nil, false},
+		{[]string{"example.com"}, nil, false},
+		{nil, []string{"1.2.3"}, false},
+		{nil, []string{"10.0.0.0/x"}, false},
+	}
+
+	for _, tst := range tests {
+		_, err := newAccessList(tst.allow, tst.deny)
+		if (err == nil) != tst.valid {
+			t.Errorf("newAccessList(%v, %v) gave error %v, expected valid=%v", tst.allow, tst.deny, err, tst.valid)
+		}
+	}
+}
+
+// TestPermitted tests the visitors our access-lists permit.
+func TestPermitted(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		address string
+		result  bool
+	}{
+		{"empty", nil, nil, "1.2.3.4", true},
+		{"empty-unparseable", nil, nil, "unknown", true},
+		{"allowed", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"not-allowed", []string{"10.0.0.0/8"}, nil, "1.2.3.4", false},
+		{"allowed-single", []string{"1.2.3.4"}, nil, "1.2.3.4", true},
+		{"allowed-ipv6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"not-allowed-ipv6", []string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+		{"denied", nil, []string{"1.2.3.0/24"}, "1.2.3.4", false},
+		{"not-denied", nil, []string{"1.2.3.0/24"}, "1.2.4.4", true},
+		{"deny-wins", []string{"10.0.0.0/8"}, []string{"10.0.0.1"}, "10.0.0.1", false},
+		{"deny-other", []string{"10.0.0.0/8"}, []string{"10.0.0.1"}, "10.0.0.2", true},
+		{"unparseable-restricted", []string{"10.0.0.0/8"}, nil, "unknown", false},
+		{"unparseable-denied", nil, []string{"1.2.3.4"}, "", false},
+	}
+
+	for _, tst := range tests {
+		list, err := newAccessList(tst.allow, tst.deny)
+		if err != nil {
+			t.Fatalf("%s: failed to create the access-list: %s", tst.name, err)
+		}
+		if out := list.permitted(tst.address); out != tst.result {
+			t.Errorf("%s: permitted(%q) gave %v, expected %v", tst.name, tst.address, out, tst.result)
+		}
+	}
+}
+
+// TestDenyAll tests that denyAll denies every visitor.
+func TestDenyAll(t *testing.T) {
+
+	list := denyAll()
+	for _, address := range []string{"1.2.3.4", "127.0.0.1", "0.0.0.0", "::1", "2001:db8::1", "::ffff:1.2.3.4", "unknown", ""} {
+		if list.permitted(address) {
+			t.Errorf("denyAll permitted %q", address)
+		}
+	}
+}
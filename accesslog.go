@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The server's access log.
+//
+// When enabled the server records each request it proxies, either in the
+// Apache "combined" format, followed by the name of the tunnel and the
+// time taken to reply in seconds, or as JSON.
+//
+// The log is rotated when it grows beyond its maximum size, by renaming it
+// with a numeric suffix, and is reopened upon SIGHUP so that it may be
+// rotated externally by logrotate.
+//
+
+// accessEntry is a single entry in our access log.
+type accessEntry struct {
+	Time      time.Time     `json:"time"`
+	Tunnel    string        `json:"tunnel"`
+	ID        string        `json:"id,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+	RemoteIP  string        `json:"remote_ip"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Seconds   float64       `json:"duration"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+// combined returns the entry in the Apache "combined" format, followed by
+// the name of the tunnel and the time taken in seconds.
+func (e accessEntry) combined() string {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	quote := func(s string) string {
+		return strconv.Quote(dash(s))
+	}
+
+	return fmt.Sprintf("%s - %s [%s] %s %d %d %s %s %s %.3f\n",
+		dash(e.RemoteIP),
+		dash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		e.Bytes,
+		quote(e.Referer),
+		quote(e.UserAgent),
+		quote(e.Tunnel),
+		e.Duration.Seconds())
+}
+
+// accessLog writes our access log.
+type accessLog struct {
+	// path is the path to the log.
+	path string
+
+	// json is true if we log as JSON, rather than in the combined
+	// format.
+	json bool
+
+	// maxSize is the size beyond which the log is rotated, if it is
+	// non-zero.
+	maxSize int64
+
+	// backups is the number of rotated logs we keep.
+	backups int
+
+	// lock protects the fields below, and serializes our writes.
+	lock sync.Mutex
+
+	// file is the log we're writing to, and size its current size.
+	file *os.File
+	size int64
+}
+
+// openAccessLog opens the access log at the given path.
+func openAccessLog(path string, format string, maxSize int64, backups int) (*accessLog, error) {
+
+	a := &accessLog{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+
+	switch format {
+	case "combined":
+	case "json":
+		a.json = true
+	default:
+		return nil, fmt.Errorf("invalid access-log format %s", format)
+	}
+
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reopen closes, and reopens, the log.
+func (a *accessLog) Reopen() error {
+	if a == nil {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.reopen()
+}
+
+// reopen closes, and reopens, the log.  The lock must be held.
+func (a *accessLog) reopen() error {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames the log, and any previous backups, then reopens it.
+// The lock must be held.
+func (a *accessLog) rotate() error {
+	if a.backups < 1 {
+		os.Remove(a.path)
+		return a.reopen()
+	}
+
+	for i := a.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.reopen()
+}
+
+// Log writes the given entry to the log.
+//
+// Errors are returned, but the entry is discarded, as a failing access
+// log shouldn't prevent requests from being served.
+func (a *accessLog) Log(e accessEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	var line string
+	if a.json {
+		e.Seconds = e.Duration.Seconds()
+		out, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		line = string(out) + "\n"
+	} else {
+		line = e.combined()
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		if err := a.reopen(); err != nil {
+			return err
+		}
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.WriteString(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the log.
+func (a *accessLog) Close() {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEntry returns an access-log entry for the given URI.
+func testEntry(uri string) accessEntry {
+	return accessEntry{
+		Time:      time.Date(2024, time.March, 5, 14, 30, 15, 0, time.UTC),
+		Tunnel:    "foo",
+		RemoteIP:  "192.0.2.1",
+		Method:    "GET",
+		URI:       uri,
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     1234,
+		Duration:  1500 * time.Millisecond,
+		UserAgent: "curl/8.0",
+	}
+}
+
+// readLines returns the lines of the given file.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", path, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// TestAccessEntryCombined tests formatting entries in the combined format.
+func TestAccessEntryCombined(t *testing.T) {
+
+	withUser := testEntry("/path")
+	withUser.User = "steve"
+	withUser.Referer = "https://example.com/"
+
+	quoted := testEntry(`/a "quoted" path`)
+	quoted.RemoteIP = ""
+	quoted.UserAgent = ""
+
+	tests := []struct {
+		name     string
+		entry    accessEntry
+		expected string
+	}{
+		{
+			name:     "simple",
+			entry:    testEntry("/"),
+			expected: `192.0.2.1 - - [05/Mar/2024:14:30:15 +0000] "GET / HTTP/1.1" 200 1234 "-" "curl/8.0" "foo" 1.500` + "\n",
+		},
+		{
+			name:     "user",
+			entry:    withUser,
+			expected: `192.0.2.1 - steve [05/Mar/2024:14:30:15 +0000] "GET /path HTTP/1.1" 200 1234 "https://example.com/" "curl/8.0" "foo" 1.500` + "\n",
+		},
+		{
+			name:     "quoted",
+			entry:    quoted,
+			expected: `- - - [05/Mar/2024:14:30:15 +0000] "GET /a \"quoted\" path HTTP/1.1" 200 1234 "-" "-" "foo" 1.500` + "\n",
+		},
+	}
+
+	for _, tst := range tests {
+		if out := tst.entry.combined(); out != tst.expected {
+			t.Errorf("%s: got %q, expected %q", tst.name, out, tst.expected)
+		}
+	}
+}
+
+// TestAccessLogFormats tests writing entries in each of our formats.
+func TestAccessLogFormats(t *testing.T) {
+
+	tests := []struct {
+		format string
+		valid  bool
+	}{
+		{"combined", true},
+		{"json", true},
+		{"common", false},
+		{"", false},
+	}
+
+	for _, tst := range tests {
+		path := filepath.Join(t.TempDir(), "access.log")
+		log, err := openAccessLog(path, tst.format, 0, 0)
+		if (err == nil) != tst.valid {
+			t.Errorf("%q: openAccessLog gave error %v, expected valid=%v", tst.format, err, tst.valid)
+			continue
+		}
+		if !tst.valid {
+			continue
+		}
+
+		if err = log.Log(testEntry("/")); err != nil {
+			t.Errorf("%q: failed to log: %s", tst.format, err)
+		}
+		log.Close()
+
+		lines := readLines(t, path)
+		if len(lines) != 1 {
+			t.Fatalf("%q: the log had %d lines", tst.format, len(lines))
+		}
+		if tst.format == "combined" {
+			if lines[0]+"\n" != testEntry("/").combined() {
+				t.Errorf("%q: the entry was %q", tst.format, lines[0])
+			}
+			continue
+		}
+
+		var entry map[string]interface{}
+		if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+			t.Fatalf("%q: the entry %q isn't JSON: %s", tst.format, lines[0], err)
+		}
+		if entry["uri"] != "/" || entry["tunnel"] != "foo" || entry["duration"] != 1.5 || entry["status"] != 200.0 {
+			t.Errorf("%q: the entry was %q", tst.format, lines[0])
+		}
+	}
+}
+
+// TestAccessLogRotation tests that the log is rotated once it reaches its
+// maximum size, keeping the given number of backups.
+func TestAccessLogRotation(t *testing.T) {
+
+	lineSize := int64(len(testEntry("/0").combined()))
+
+	tests := []struct {
+		name    string
+		maxSize int64
+		backups int
+		entries int
+
+		// lines holds the number of lines we expect in the log,
+		// and then in each of its backups.
+		lines []int
+	}{
+		{"unlimited", 0, 3, 5, []int{5}},
+		{"one-per-file", lineSize, 2, 5, []int{1, 1, 1}},
+		{"two-per-file", 2 * lineSize, 3, 5, []int{1, 2, 2}},
+		{"no-backups", 2 * lineSize, 0, 5, []int{1}},
+	}
+
+	for _, tst := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "access.log")
+
+		log, err := openAccessLog(path, "combined", tst.maxSize, tst.backups)
+		if err != nil {
+			t.Fatalf("%s: failed to open the log: %s", tst.name, err)
+		}
+		for i := 0; i < tst.entries; i++ {
+			if err = log.Log(testEntry(fmt.Sprintf("/%d", i))); err != nil {
+				t.Errorf("%s: failed to log: %s", tst.name, err)
+			}
+		}
+		log.Close()
+
+		files, _ := filepath.Glob(path + "*")
+		if len(files) != len(tst.lines) {
+			t.Errorf("%s: found the files %v, expected %d", tst.name, files, len(tst.lines))
+			continue
+		}
+
+		//
+		// The newest entries are in the log, and older entries
+		// in each successive backup.
+		//
+		last := tst.entries
+		for i, count := range tst.lines {
+			name := path
+			if i > 0 {
+				name = fmt.Sprintf("%s.%d", path, i)
+			}
+			lines := readLines(t, name)
+			if len(lines) != count {
+				t.Errorf("%s: %s had %d lines, expected %d", tst.name, name, len(lines), count)
+				continue
+			}
+			last -= count
+			if !strings.Contains(lines[0], fmt.Sprintf(`"GET /%d HTTP/1.1"`, last)) {
+				t.Errorf("%s: %s began with %q, expected /%d", tst.name, name, lines[0], last)
+			}
+		}
+	}
+}
+
+// TestAccessLogReopen tests that the log is reopened, as it is upon
+// SIGHUP, once it has been rotated externally.
+func TestAccessLogReopen(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	log, err := openAccessLog(path, "combined", 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open the log: %s", err)
+	}
+	defer log.Close()
+
+	log.Log(testEntry("/before"))
+	if err = os.Rename(path, path+".old"); err != nil {
+		t.Fatalf("failed to rename the log: %s", err)
+	}
+	log.Log(testEntry("/renamed"))
+
+	if err = log.Reopen(); err != nil {
+		t.Fatalf("failed to reopen the log: %s", err)
+	}
+	log.Log(testEntry("/after"))
+
+	tests := []struct {
+		path string
+		uris []string
+	}{
+		{path + ".old", []string{"/before", "/renamed"}},
+		{path, []string{"/after"}},
+	}
+
+	for _, tst := range tests {
+		lines := readLines(t, tst.path)
+		if len(lines) != len(tst.uris) {
+			t.Errorf("%s had %d lines, expected %d", tst.path, len(lines), len(tst.uris))
+			continue
+		}
+		for i, uri := range tst.uris {
+			if !strings.Contains(lines[i], `"GET `+uri+` HTTP/1.1"`) {
+				t.Errorf("%s: line %d was %q, expected %s", tst.path, i, lines[i], uri)
+			}
+		}
+	}
+}
+
+// TestAccessLogDisabled tests that a missing log may be used, and does
+// nothing.
+func TestAccessLogDisabled(t *testing.T) {
+
+	var log *accessLog
+	if err := log.Log(testEntry("/")); err != nil {
+		t.Errorf("logging to a missing log failed: %s", err)
+	}
+	if err := log.Reopen(); err != nil {
+		t.Errorf("reopening a missing log failed: %s", err)
+	}
+	log.Close()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The server's admin listener.
+//
+// This is bound to a separate address from that which serves visitors, so
+// that it can be kept private, and reports upon our health:
+//
+//	/healthz reports that we're running.
+//	/readyz reports whether we're able to proxy requests, which requires
+//	        that we're connected to the broker, subscribed to the topics
+//	        our dispatcher relies upon, and not shutting down.
+//	/metrics serves our metrics, in the Prometheus format.
+//
+// The health endpoints return a JSON object describing our state, with a
+// status-code of 200 if all is well, and 503 otherwise.
+//
+
+// adminStatus is the JSON object returned by our health endpoints.
+type adminStatus struct {
+	// Status is either "ok" or "unavailable".
+	Status string `json:"status"`
+
+	// Broker is true if we're connected to the broker.
+	Broker bool `json:"broker"`
+
+	// Subscribed is true if we're subscribed to the topics upon which
+	// our clients announce themselves, and send their replies.
+	Subscribed bool `json:"subscribed"`
+
+	// Stopping is true if we're shutting down.
+	Stopping bool `json:"stopping"`
+
+	// Pending is the number of requests awaiting a reply.
+	Pending int `json:"pending"`
+
+	// Tunnels is the number of tunnels which have been announced.
+	Tunnels int `json:"tunnels"`
+}
+
+// adminHandler returns the handler for our admin listener.
+func (p *serveCmd) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		p.writeStatus(w, true)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		st := p.status()
+		p.writeStatus(w, st.Broker && st.Subscribed && !st.Stopping)
+	})
+	mux.Handle("/metrics", p.metrics.handler())
+	return mux
+}
+
+// status returns our current state.
+func (p *serveCmd) status() adminStatus {
+	st := adminStatus{
+		Broker:     p.connected.Load(),
+		Subscribed: p.subscribed.Load(),
+		Stopping:   p.stopping.Load(),
+	}
+
+	p.pendingLock.Lock()
+	st.Pending = len(p.pending)
+	p.pendingLock.Unlock()
+
+	p.clientsLock.Lock()
+	st.Tunnels = len(p.clients)
+	p.clientsLock.Unlock()
+
+	return st
+}
+
+// writeStatus sends our current state, with a status-code reflecting
+// whether we're healthy.
+func (p *serveCmd) writeStatus(w http.ResponseWriter, healthy bool) {
+	st := p.status()
+
+	code := http.StatusOK
+	st.Status = "ok"
+	if !healthy {
+		code = http.StatusServiceUnavailable
+		st.Status = "unavailable"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(st)
+}
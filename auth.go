@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password protection.
+//
+// A tunnel may be protected by HTTP basic-authentication, with the users
+// given to the client via -auth, or read from an htpasswd file.  The
+// client announces the names of the users, along with bcrypt hashes of
+// their passwords, and the server requires visitors to authenticate as
+// one of them before their requests are forwarded.  The credentials are
+// then removed from the request, so they never reach the service.
+//
+// The announcement is a retained message, which the server trusts, so
+// the protection is only as strong as the broker's access-control.  A
+// tunnel which hasn't been announced is refused entirely, rather than
+// being forwarded without a password.
+//
+// The server may also be given an htpasswd file of its own, whose users
+// may access every tunnel.
+//
+
+// loadHtpasswd reads the users, and the hashes of their passwords, from
+// the given htpasswd file.
+//
+// Only bcrypt hashes are supported, as created by "htpasswd -B".
+func loadHtpasswd(path string) (map[string]string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s: invalid line %q", path, line)
+		}
+		if _, err = bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s: the password of %s isn't a bcrypt hash; use htpasswd -B", path, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// hashPasswords returns the users given as "user:password", with bcrypt
+// hashes of their passwords.
+func hashPasswords(list []string) (map[string]string, error) {
+	users := make(map[string]string)
+	for _, ent := range list {
+		user, password, ok := strings.Cut(ent, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("invalid credentials, expected user:password")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		users[user] = string(hash)
+	}
+	return users, nil
+}
+
+// maxCachedPasswords is the number of verified passwords we remember.
+const maxCachedPasswords = 1000
+
+// passwordCache remembers the passwords we've verified.
+//
+// Comparing a password against a bcrypt hash is deliberately slow, so
+// rather than doing so for every request a visitor makes we remember
+// the (hashed) passwords which matched.
+type passwordCache struct {
+	lock  sync.Mutex
+	valid map[[sha256.Size]byte]bool
+}
+
+// check returns true if the given password matches the given hash.
+func (c *passwordCache) check(hash string, password string) bool {
+	key := sha256.Sum256([]byte(hash + "\x00" + password))
+
+	c.lock.Lock()
+	ok := c.valid[key]
+	c.lock.Unlock()
+	if ok {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.valid == nil || len(c.valid) >= maxCachedPasswords {
+		c.valid = make(map[[sha256.Size]byte]bool)
+	}
+	c.valid[key] = true
+	return true
+}
+
+// authenticate returns true if the given request carries the credentials
+// of a user within any of the given lists, along with the name of the
+// user it claims to be.
+func (c *passwordCache) authenticate(r *http.Request, lists ...map[string]string) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	for _, users := range lists {
+		if hash, found := users[user]; found && c.check(hash, password) {
+			return user, true
+		}
+	}
+	return user, false
+}
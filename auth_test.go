@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// mustHash returns a (cheap) bcrypt hash of the given password.
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash the password: %s", err)
+	}
+	return string(hash)
+}
+
+// TestLoadHtpasswd tests the parsing of htpasswd files.
+func TestLoadHtpasswd(t *testing.T) {
+
+	hash := mustHash(t, "secret")
+
+	tests := []struct {
+		name    string
+		content string
+		users   map[string]string
+		valid   bool
+	}{
+		{"empty", "", map[string]string{}, true},
+		{"single", "steve:" + hash + "\n", map[string]string{"steve": hash}, true},
+		{"comments", "# users\n\n  steve:" + hash + "  \n#bob:x\n", map[string]string{"steve": hash}, true},
+		{"multiple", "steve:" + hash + "\nbob:" + hash, map[string]string{"steve": hash, "bob": hash}, true},
+		{"no-colon", "steve\n", nil, false},
+		{"no-user", ":" + hash + "\n", nil, false},
+		{"md5", "steve:$apr1$Vu5pSH4E$Dk2tL7s0ZtMeBoo7QyOo20\n", nil, false},
+		{"sha1", "steve:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", nil, false},
+		{"plain", "steve:secret\n", nil, false},
+	}
+
+	for _, tst := range tests {
+		path := filepath.Join(t.TempDir(), "htpasswd")
+		if err := os.WriteFile(path, []byte(tst.content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %s", path, err)
+		}
+
+		users, err := loadHtpasswd(path)
+		if (err == nil) != tst.valid {
+			t.Errorf("%s: loadHtpasswd gave error %v, expected valid=%v", tst.name, err, tst.valid)
+			continue
+		}
+		if !tst.valid {
+			continue
+		}
+		if len(users) != len(tst.users) {
+			t.Errorf("%s: loadHtpasswd gave %d users, expected %d", tst.name, len(users), len(tst.users))
+		}
+		for user, expected := range tst.users {
+			if users[user] != expected {
+				t.Errorf("%s: the hash of %s was %q, expected %q", tst.name, user, users[user], expected)
+			}
+		}
+	}
+
+	if _, err := loadHtpasswd(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("loadHtpasswd succeeded with a missing file")
+	}
+}
+
+// TestAuthenticate tests the checking of visitors' credentials.
+func TestAuthenticate(t *testing.T) {
+
+	tunnel := map[string]string{"steve": mustHash(t, "secret")}
+	server := map[string]string{"admin": mustHash(t, "root")}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		noAuth   bool
+		lists    []map[string]string
+		login    string
+		result   bool
+	}{
+		{"valid", "steve", "secret", false, []map[string]string{tunnel}, "steve", true},
+		{"wrong-password", "steve", "wrong", false, []map[string]string{tunnel}, "steve", false},
+		{"empty-password", "steve", "", false, []map[string]string{tunnel}, "steve", false},
+		{"unknown-user", "bob", "secret", false, []map[string]string{tunnel}, "bob", false},
+		{"no-credentials", "", "", true, []map[string]string{tunnel}, "", false},
+		{"no-lists", "steve", "secret", false, nil, "steve", false},
+		{"second-list", "admin", "root", false, []map[string]string{tunnel, server}, "admin", true},
+		{"other-list", "admin", "root", false, []map[string]string{tunnel}, "admin", false},
+		{"cross-list", "steve", "root", false, []map[string]string{tunnel, server}, "steve", false},
+	}
+
+	var cache passwordCache
+
+	//
+	// Run the tests twice, so that the second time around we'll
+	// test the passwords we've cached.
+	//
+	for i := 0; i < 2; i++ {
+		for _, tst := range tests {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			if !tst.noAuth {
+				req.SetBasicAuth(tst.user, tst.password)
+			}
+
+			login, ok := cache.authenticate(req, tst.lists...)
+			if ok != tst.result || login != tst.login {
+				t.Errorf("%s: authenticate gave (%q, %v), expected (%q, %v)", tst.name, login, ok, tst.login, tst.result)
+			}
+		}
+	}
+}
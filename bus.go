@@ -0,0 +1,150 @@
+package main
+
+import (
+	"time"
+)
+
+// The message-bus which connects the server and the clients.
+//
+// We can speak either MQTT 3.1.1, or MQTT 5, to the broker.  The two
+// protocols are handled by different libraries, so we hide them behind
+// the Bus interface.
+//
+// MQTT 5 allows a message to carry properties, which we use to implement
+// request/response natively: a request names the topic to which the reply
+// should be sent, carries correlation-data identifying it, and expires if
+// it isn't delivered before the server gives up waiting.  When speaking
+// MQTT 3.1.1 these properties are silently dropped, and we fall back to
+// deriving the same information from the topic-names.
+//
+
+// capMQTT5 is the capability announced by a peer which is speaking MQTT 5,
+// and so can receive message-properties.
+const capMQTT5 = "mqtt5"
+
+// Message is a message received from the message-bus.
+type Message struct {
+	// Topic is the topic the message was published upon.
+	Topic string
+
+	// Payload is the body of the message.
+	Payload []byte
+
+	// ResponseTopic is the topic to which a reply should be sent,
+	// if the sender specified one.  (MQTT 5 only.)
+	ResponseTopic string
+
+	// Correlation is the correlation-data the sender specified, which
+	// should be included in the reply.  (MQTT 5 only.)
+	Correlation []byte
+
+	// Properties holds the user-properties the sender specified.
+	// (MQTT 5 only.)
+	Properties map[string]string
+}
+
+// Publication is a message to be published upon the message-bus.
+type Publication struct {
+	// Topic is the topic to publish upon.
+	Topic string
+
+	// Payload is the body of the message.
+	Payload []byte
+
+	// Retain is true if the broker should retain the message.
+	Retain bool
+
+	// ResponseTopic is the topic to which a reply should be sent.
+	// (MQTT 5 only.)
+	ResponseTopic string
+
+	// Correlation is the correlation-data to be included in a reply.
+	// (MQTT 5 only.)
+	Correlation []byte
+
+	// Expiry is the time after which the broker should discard the
+	// message if it hasn't been delivered.  (MQTT 5 only.)
+	Expiry time.Duration
+
+	// Properties holds user-properties to attach to the message.
+	// (MQTT 5 only.)
+	Properties map[string]string
+}
+
+// MessageHandler is invoked when a message is received upon a topic
+// we've subscribed to.
+type MessageHandler func(bus Bus, msg *Message)
+
+// Bus is the interface to our message-bus.
+type Bus interface {
+
+	// MQTT5 returns true if we're speaking MQTT 5.
+	MQTT5() bool
+
+	// Publish publishes the given message.
+	Publish(pub *Publication) error
+
+	// Subscribe subscribes to the given topic-filter, invoking the
+	// handler for each message received.
+	Subscribe(filter string, handler MessageHandler) error
+
+	// Disconnect closes our connection.
+	Disconnect()
+}
+
+// BusOptions holds the options used to connect to the message-bus.
+type BusOptions struct {
+
+	// Broker is the host:port of the MQ-server.
+	Broker string
+
+	// MQTT5 is true if we should speak MQTT 5, rather than 3.1.1.
+	MQTT5 bool
+
+	// ClientID is the ID we identify ourselves with.
+	ClientID string
+
+	// Username and Password are the credentials we authenticate with,
+	// if the broker requires them.
+	Username string
+	Password string
+
+	// Will is published by the broker if we disconnect unexpectedly.
+	Will *Publication
+
+	// ReconnectMax is the maximum delay between attempts to reconnect.
+	ReconnectMax time.Duration
+
+	// OnConnect is invoked when we connect, and every time we
+	// reconnect, allowing subscriptions to be made.
+	OnConnect func(bus Bus)
+
+	// OnConnectionLost is invoked when our connection is lost.
+	OnConnectionLost func(err error)
+
+	// OnReconnecting is invoked when we attempt to reconnect, with
+	// the error from the previous attempt if there was one.
+	OnReconnecting func(err error)
+}
+
+// defaultReconnectMax is the maximum delay between attempts to reconnect,
+// if none is specified.
+const defaultReconnectMax = time.Minute
+
+// connectTimeout is how long we wait for our initial connection.
+const connectTimeout = 10 * time.Second
+
+// NewBus connects to the message-bus with the given options.
+//
+// If the initial connection fails an error is returned, but once that
+// has succeeded we'll reconnect automatically whenever our connection
+// is lost.
+func NewBus(opts BusOptions) (Bus, error) {
+	if opts.ReconnectMax <= 0 {
+		opts.ReconnectMax = defaultReconnectMax
+	}
+	if opts.MQTT5 {
+		return newMQTT5Bus(opts)
+	}
+	return newMQTT3Bus(opts)
+}
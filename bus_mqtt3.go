@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqtt3Bus is a Bus which speaks MQTT 3.1.1.
+type mqtt3Bus struct {
+	client MQTT.Client
+
+	// stop is closed when we disconnect, to abandon any attempt to
+	// reconnect.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newMQTT3Bus connects to the broker with MQTT 3.1.1.
+func newMQTT3Bus(opts BusOptions) (Bus, error) {
+
+	bus := &mqtt3Bus{stop: make(chan struct{})}
+
+	o := MQTT.NewClientOptions().AddBroker("tcp://" + opts.Broker)
+	o.SetClientID(opts.ClientID)
+	o.SetUsername(opts.Username)
+	o.SetPassword(opts.Password)
+
+	if opts.Will != nil {
+		o.SetBinaryWill(opts.Will.Topic, opts.Will.Payload, 0, opts.Will.Retain)
+	}
+
+	//
+	// If our connection is lost we'll reconnect.
+	//
+	// We do that ourselves, rather than via the library, as it
+	// doesn't tell us why an attempt to reconnect failed.
+	//
+	o.SetAutoReconnect(false)
+	o.SetConnectTimeout(connectTimeout)
+	o.SetConnectionLostHandler(func(c MQTT.Client, err error) {
+		if opts.OnConnectionLost != nil {
+			opts.OnConnectionLost(err)
+		}
+		go bus.reconnect(opts)
+	})
+
+	//
+	// Because we use a clean session our subscriptions are lost if
+	// our connection is dropped, so this is invoked upon every
+	// reconnection.
+	//
+	o.OnConnect = func(c MQTT.Client) {
+		if opts.OnConnect != nil {
+			opts.OnConnect(bus)
+		}
+	}
+
+	bus.client = MQTT.NewClient(o)
+	if token := bus.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return bus, nil
+}
+
+// reconnect attempts to reconnect to the broker, until we succeed or we're
+// disconnected.
+//
+// Failing attempts are retried with an exponential backoff, capped at the
+// maximum interval we've been given.
+func (b *mqtt3Bus) reconnect(opts BusOptions) {
+	delay := time.Second
+	var err error
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		if opts.OnReconnecting != nil {
+			opts.OnReconnecting(err)
+		}
+
+		token := b.client.Connect()
+		token.Wait()
+		if err = token.Error(); err == nil {
+			return
+		}
+
+		delay *= 2
+		if delay > opts.ReconnectMax {
+			delay = opts.ReconnectMax
+		}
+	}
+}
+
+// MQTT5 returns false, as we speak MQTT 3.1.1.
+func (b *mqtt3Bus) MQTT5() bool {
+	return false
+}
+
+// Publish publishes the given message.
+//
+// MQTT 3.1.1 doesn't support message-properties, so they're ignored.
+func (b *mqtt3Bus) Publish(pub *Publication) error {
+	token := b.client.Publish(pub.Topic, 0, pub.Retain, pub.Payload)
+	token.Wait()
+	return token.Error()
+}
+
+// Subscribe subscribes to the given topic-filter.
+func (b *mqtt3Bus) Subscribe(filter string, handler MessageHandler) error {
+	token := b.client.Subscribe(filter, 0, func(c MQTT.Client, msg MQTT.Message) {
+		handler(b, &Message{Topic: msg.Topic(), Payload: msg.Payload()})
+	})
+	token.Wait()
+	return token.Error()
+}
+
+// Disconnect closes our connection.
+func (b *mqtt3Bus) Disconnect() {
+	b.stopOnce.Do(func() { close(b.stop) })
+	b.client.Disconnect(250)
+}
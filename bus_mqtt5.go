@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// mqtt5Bus is a Bus which speaks MQTT 5.
+type mqtt5Bus struct {
+	cm *autopaho.ConnectionManager
+
+	// handlers holds the handler for each topic-filter we've
+	// subscribed to.
+	//
+	// Unlike the 3.1.1 library all messages are delivered to a single
+	// callback, so we have to route them ourselves.
+	handlers map[string]MessageHandler
+
+	// handlersLock protects our handlers-map.
+	handlersLock sync.Mutex
+}
+
+// newMQTT5Bus connects to the broker with MQTT 5.
+func newMQTT5Bus(opts BusOptions) (Bus, error) {
+
+	bus := &mqtt5Bus{handlers: make(map[string]MessageHandler)}
+
+	broker, err := url.Parse("mqtt://" + opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// Failing attempts to reconnect are retried with an exponential
+	// backoff, capped at the maximum interval we've been given.
+	//
+	minDelay := time.Second
+	initialDelay := 2 * time.Second
+	if opts.ReconnectMax < initialDelay {
+		opts.ReconnectMax = initialDelay
+	}
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:       []*url.URL{broker},
+		KeepAlive:        30,
+		ReconnectBackoff: autopaho.NewExponentialBackoff(minDelay, opts.ReconnectMax, initialDelay, 2),
+		ConnectTimeout:   connectTimeout,
+		ConnectUsername:  opts.Username,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+
+			//
+			// This callback must not block, but the handler
+			// will wish to make subscriptions.
+			//
+			if opts.OnConnect != nil {
+				go opts.OnConnect(bus)
+			}
+		},
+		OnConnectionDown: func() bool {
+			if opts.OnConnectionLost != nil {
+				opts.OnConnectionLost(fmt.Errorf("connection lost"))
+			}
+			return true
+		},
+		OnConnectError: func(err error) {
+			if opts.OnReconnecting != nil {
+				opts.OnReconnecting(err)
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: opts.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				bus.onPublish,
+			},
+		},
+	}
+
+	if opts.Password != "" {
+		cfg.ConnectPassword = []byte(opts.Password)
+	}
+
+	if opts.Will != nil {
+		cfg.WillMessage = &paho.WillMessage{
+			Topic:   opts.Will.Topic,
+			Payload: opts.Will.Payload,
+			Retain:  opts.Will.Retain,
+		}
+	}
+
+	bus.cm, err = autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// Wait for our initial connection.
+	//
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err = bus.cm.AwaitConnection(ctx); err != nil {
+		bus.Disconnect()
+		return nil, fmt.Errorf("failed to connect to %s: %s", opts.Broker, err)
+	}
+	return bus, nil
+}
+
+// onPublish is invoked for every message we receive, and routes it to
+// the appropriate handler.
+func (b *mqtt5Bus) onPublish(pr paho.PublishReceived) (bool, error) {
+
+	msg := &Message{
+		Topic:   pr.Packet.Topic,
+		Payload: pr.Packet.Payload,
+	}
+
+	if props := pr.Packet.Properties; props != nil {
+		msg.ResponseTopic = props.ResponseTopic
+		msg.Correlation = props.CorrelationData
+		if len(props.User) > 0 {
+			msg.Properties = make(map[string]string)
+			for _, ent := range props.User {
+				msg.Properties[ent.Key] = ent.Value
+			}
+		}
+	}
+
+	var matched []MessageHandler
+	b.handlersLock.Lock()
+	for filter, handler := range b.handlers {
+		if topicMatches(filter, msg.Topic) {
+			matched = append(matched, handler)
+		}
+	}
+	b.handlersLock.Unlock()
+
+	for _, handler := range matched {
+		handler(b, msg)
+	}
+	return len(matched) > 0, nil
+}
+
+// MQTT5 returns true, as we speak MQTT 5.
+func (b *mqtt5Bus) MQTT5() bool {
+	return true
+}
+
+// Publish publishes the given message, along with its properties.
+func (b *mqtt5Bus) Publish(pub *Publication) error {
+
+	props := &paho.PublishProperties{
+		ResponseTopic:   pub.ResponseTopic,
+		CorrelationData: pub.Correlation,
+	}
+	if pub.Expiry > 0 {
+		expiry := uint32(math.Ceil(pub.Expiry.Seconds()))
+		props.MessageExpiry = &expiry
+	}
+	for key, val := range pub.Properties {
+		props.User.Add(key, val)
+	}
+
+	_, err := b.cm.Publish(context.Background(), &paho.Publish{
+		Topic:      pub.Topic,
+		Payload:    pub.Payload,
+		Retain:     pub.Retain,
+		Properties: props,
+	})
+	return err
+}
+
+// Subscribe subscribes to the given topic-filter.
+func (b *mqtt5Bus) Subscribe(filter string, handler MessageHandler) error {
+
+	b.handlersLock.Lock()
+	b.handlers[filter] = handler
+	b.handlersLock.Unlock()
+
+	_, err := b.cm.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: filter, QoS: 0},
+		},
+	})
+	return err
+}
+
+// Disconnect closes our connection.
+func (b *mqtt5Bus) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	b.cm.Disconnect(ctx)
+}
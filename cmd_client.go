@@ -17,31 +17,34 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
-	"os"
-	"sort"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	ui "github.com/gizak/termui/v3"
 	"github.com/gizak/termui/v3/widgets"
 	"github.com/google/subcommands"
 	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // clientCmd is the structure for this sub-command.
 type clientCmd struct {
 
 	//
-	// The name we'll access this resource via.
+	// The name we'll access this resource via, if it is not named
+	// by the -expose flag.
 	//
 	name string
 
@@ -55,23 +58,254 @@ type clientCmd struct {
 	tunnel string
 
 	//
-	// The service to expose, expressed as 1.2.3.4:NN
+	// The services to expose, each expressed as 1.2.3.4:NN, as a URL
+	// such as https://localhost:8443, or as a Unix domain socket such
+	// as unix:/run/app.sock, and optionally prefixed by "name=".
 	//
-	expose string
+	expose stringList
 
 	//
-	// A map of the HTTP-status-codes we've returned and their count.
+	// The options for connecting to the services.
 	//
-	stats map[string]int
+	upstreamOpts upstreamOptions
 
 	//
-	// The recent requests we've seen.
+	// The options for each tunnel, which we announce to the server.
 	//
-	requests []Request
+	tunnelOpts tunnelOptions
+
+	//
+	// The tunnels we're exposing, each with its own statistics.
+	//
+	tunnels []*tunnel
+
+	//
+	// The configuration file we read, and the profile within it which
+	// we use.
+	//
+	config  string
+	profile string
 
 	//
 	// The port to connect to MQ with
 	mqPort int
+
+	//
+	// The credentials to connect to MQ with.
+	//
+	mqUsername string
+	mqPassword string
+
+	//
+	// The prefix for our MQ topics.
+	//
+	topicPrefix string
+
+	//
+	// The maximum delay between attempts to reconnect to MQ.
+	//
+	reconnectMax time.Duration
+
+	//
+	// Should we speak MQTT 5 to the broker?
+	//
+	mqtt5 bool
+
+	//
+	// The state of our MQ connection, which is shown in the GUI.
+	//
+	state connState
+
+	//
+	// The address to serve our metrics upon, if any, and the metrics
+	// themselves.
+	//
+	metricsAddr string
+	metrics     *clientMetrics
+
+	//
+	// The address of the collector we export our spans to, if any.
+	//
+	otlpEndpoint string
+
+	//
+	// The options for our logging, and our logger.
+	//
+	// We only log if we're given a file to log to, as otherwise our
+	// messages would corrupt the GUI.
+	//
+	logOpts logOptions
+	log     *slog.Logger
+}
+
+// connState holds the state of our connection to the message-bus.
+//
+// It is updated by the MQ callbacks, which run in their own goroutines,
+// and read by the GUI, so all access must go through the mutex.
+type connState struct {
+	sync.Mutex
+
+	// connected is true if we're currently connected to MQ.
+	connected bool
+
+	// attempts holds the number of reconnection attempts made since
+	// the connection was lost.
+	attempts int
+
+	// lastError holds the most recent error we've encountered.
+	lastError string
+
+	// since holds the time at which we last connected, or lost
+	// our connection.
+	since time.Time
+
+	// server holds the most recent Hello message from the server.
+	server Hello
+}
+
+// setConnected records that we've (re)connected to MQ.
+func (c *connState) setConnected() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.connected = true
+	c.attempts = 0
+	c.since = time.Now()
+}
+
+// setLost records that our connection to MQ has been lost.
+func (c *connState) setLost(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.connected = false
+	c.since = time.Now()
+	if err != nil {
+		c.lastError = err.Error()
+	}
+}
+
+// setReconnecting records that a reconnection attempt is being made,
+// along with the error from the previous attempt if there was one.
+func (c *connState) setReconnecting(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.connected = false
+	c.attempts++
+	if err != nil {
+		c.lastError = err.Error()
+	}
+}
+
+// isConnected returns true if we're currently connected to MQ.
+func (c *connState) isConnected() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.connected
+}
+
+// setServer records the Hello message announced by the server.
+func (c *connState) setServer(hello Hello) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.server = hello
+}
+
+// serverStopping returns true if the server has announced that it is
+// stopping, or has gone offline.
+func (c *connState) serverStopping() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.server.State == stateStopping || c.server.State == stateOffline
+}
+
+// serverCapabilities returns the capabilities announced by the server.
+func (c *connState) serverCapabilities() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.server.Capabilities
+}
+
+// setError records an error, for display in the GUI.
+func (c *connState) setError(format string, args ...interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.lastError = fmt.Sprintf(format, args...)
+}
+
+// String returns a human-readable description of the connection state,
+// suitable for display in the GUI.
+func (c *connState) String() string {
+	c.Lock()
+	defer c.Unlock()
+
+	state := "connected"
+	label := "Connected for"
+	if !c.connected {
+		state = "reconnecting"
+		label = "Disconnected for"
+	}
+
+	out := fmt.Sprintf("\n  State: %s\n", state)
+	out += fmt.Sprintf("  Reconnection attempts: %d\n", c.attempts)
+	out += fmt.Sprintf("  %s: %s\n", label, formatDuration(time.Since(c.since)))
+	if c.server.State != "" {
+		out += fmt.Sprintf("  Server: %s, running tunneller %s\n", c.server.State, c.server.Software)
+	}
+	if c.lastError != "" {
+		out += fmt.Sprintf("  Last error: %s\n", c.lastError)
+	}
+	return out
+}
+
+// formatDuration formats the given duration as "HH:MM:SS", prefixed by
+// the number of days if that is non-zero.
+func formatDuration(ts time.Duration) string {
+
+	const (
+		Decisecond = 100 * time.Millisecond
+		Day        = 24 * time.Hour
+	)
+
+	sign := time.Duration(1)
+	if ts < 0 {
+		sign = -1
+		ts = -ts
+	}
+	ts += +Decisecond / 2
+	d := sign * (ts / Day)
+	ts = ts % Day
+	h := ts / time.Hour
+	ts = ts % time.Hour
+	m := ts / time.Minute
+	ts = ts % time.Minute
+	s := ts / time.Second
+
+	if d > 0 {
+		if d == 1 {
+			return fmt.Sprintf("%02d day %02d:%02d:%02d", d, h, m, s)
+		}
+		return fmt.Sprintf("%02d days %02d:%02d:%02d", d, h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", h, m, s)
+}
+
+// requestColumns returns the widths of the columns of our table of recent
+// requests, given the width of the terminal and of the addresses shown.
+//
+// The request itself gets whatever space remains, if any.
+func requestColumns(termWidth int, ipWidth int) []int {
+	rest := termWidth - ipWidth - 46
+	if rest < 1 {
+		rest = 1
+	}
+	return []int{ipWidth, 38, 8, rest}
 }
 
 // Name returns the name of this sub-command.
@@ -82,152 +316,311 @@ func (p *clientCmd) Synopsis() string { return "Launch our client." }
 
 // Usage returns details of this sub-command.
 func (p *clientCmd) Usage() string {
-	return `client :
-  Launch the client, exposing a local service to the internet
+	return `client [options] [tunnel ...]:
+  Launch the client, exposing local services to the internet.
+
+  The tunnels named upon the command-line, or those of the profile
+  given by -profile, are read from the configuration file.  Any flag
+  may also be set via an environment variable, for example -mq-port
+  via $TUNNELLER_MQ_PORT.
 `
 }
 
 // SetFlags configures the flags this sub-command accepts.
 func (p *clientCmd) SetFlags(f *flag.FlagSet) {
 
-	f.StringVar(&p.expose, "expose", "", "The host/port to expose to the internet.")
+	f.Var(&p.expose, "expose", "The host/port, http/https URL, or unix:/path/to/socket to expose to the internet, optionally prefixed by name=.  May be repeated.")
 	f.StringVar(&p.tunnel, "tunnel", "tunnel.steve.fi", "The address of the publicly visible tunnel-host")
-	f.StringVar(&p.name, "name", "", "The name for this connection")
+	f.DurationVar(&p.upstreamOpts.timeout, "upstream-timeout", 30*time.Second, "The maximum time to wait for the exposed service to reply")
+	f.BoolVar(&p.upstreamOpts.insecure, "upstream-insecure", false, "Don't verify the TLS certificate of an https:// service")
+	f.StringVar(&p.upstreamOpts.caFile, "upstream-ca", "", "A PEM file containing the CA used to verify an https:// service")
+	f.StringVar(&p.upstreamOpts.serverName, "upstream-sni", "", "The server name to send to, and verify for, an https:// service")
+	f.StringVar(&p.upstreamOpts.certFile, "upstream-cert", "", "A PEM file containing a client certificate to present to an https:// service")
+	f.StringVar(&p.upstreamOpts.keyFile, "upstream-key", "", "A PEM file containing the key for -upstream-cert")
+	f.StringVar(&p.tunnelOpts.forwarded, "forwarded-headers", forwardedAll, "The forwarding headers the server adds to requests: all, x-forwarded, forwarded, or none")
+	f.Var((*stringList)(&p.tunnelOpts.allow), "allow", "An address, CIDR range, or file listing them, which visitors may make requests from; may be repeated")
+	f.Var((*stringList)(&p.tunnelOpts.auth), "auth", "The user:password visitors must authenticate with; may be repeated")
+	f.StringVar(&p.tunnelOpts.htpasswd, "htpasswd", "", "An htpasswd file, of bcrypt hashes, listing the users visitors must authenticate as")
+	f.Var((*stringList)(&p.tunnelOpts.deny), "deny", "An address, CIDR range, or file listing them, which visitors may not make requests from; may be repeated")
+	f.StringVar(&p.name, "name", "", "The name for an -expose which isn't named")
 	f.IntVar(&p.mqPort, "mq-port", 1883, "The MQ port")
+	f.StringVar(&p.mqUsername, "mq-username", "", "The username to authenticate to MQ with")
+	f.StringVar(&p.mqPassword, "mq-password", "", "The password to authenticate to MQ with")
+	p.logOpts.SetFlags(f, true)
+	f.StringVar(&p.metricsAddr, "metrics", "", "The host:port to serve Prometheus metrics upon, via /metrics, if any")
+	f.StringVar(&p.otlpEndpoint, "otlp-endpoint", "", "The URL of the OpenTelemetry collector to export traces to, if any")
+	f.StringVar(&p.config, "config", defaultConfigPath(), "The configuration file to read")
+	f.StringVar(&p.profile, "profile", "", "The profile to use from the configuration file")
+	f.StringVar(&p.topicPrefix, "topic-prefix", defaultTopicPrefix, "The prefix for our MQ topics")
+	f.DurationVar(&p.reconnectMax, "reconnect-max", time.Minute, "The maximum delay between attempts to reconnect to MQ")
+	f.BoolVar(&p.mqtt5, "mqtt5", false, "Speak MQTT 5, rather than MQTT 3.1.1, to the broker")
+}
+
+// logError records an error for display in the GUI, and logs it along with
+// the given attributes.
+func (p *clientCmd) logError(msg string, err error, attrs ...any) {
+	p.state.setError("%s: %s", msg, err.Error())
+	p.log.Error(msg, append(attrs, "error", err)...)
 }
 
-// onMessage is called when a message is received upon the MQ-topic we're
-// watching.
+// onMessage is called when a message is received upon the MQ-topic of
+// one of our tunnels.
 //
 // We have to perform the HTTP-fetch which is contained within the message,
-// and submit the result back to that same topic.
-func (p *clientCmd) onMessage(client MQTT.Client, msg MQTT.Message) {
+// and submit the result back to the response-topic for that request.
+func (p *clientCmd) onMessage(t *tunnel, bus Bus, msg *Message) {
 
 	//
 	// Get the text of the request.
 	//
-	fetch := msg.Payload()
-
-	//
-	// If this is one of our replies ignore it.
-	//
-	// Because we receive requests and post the replies upon the
-	// same topic we make sure that our replies are prefixed with
-	// `X-`, this means we can avoid processing the requests that
-	// we sent ourselves.
-	//
-	if strings.HasPrefix(string(fetch), "X-") {
-		return
-	}
+	fetch := msg.Payload
 
 	//
-	// OK if it isn't one of our requests it should be a JSON-object
+	// The request should be a JSON-object.
 	//
 	var req Request
 	err := json.Unmarshal([]byte(fetch), &req)
 	if err != nil {
 
 		//
-		// TODO: This needs better handling.
+		// We can't print this, as it would corrupt our GUI,
+		// so we record it for display instead.
 		//
-		fmt.Printf("Failed to unmarshal ..: %s\n", err.Error())
+		p.logError("failed to unmarshal request", err, "tunnel", t.name)
 		return
 	}
 
 	//
-	// This is the result we'll publish back onto the topic in the case
-	// that we cannot successfully communicate with the local service
-	// we're trying to expose.
+	// If the server speaks MQTT 5 it sends the metadata about the
+	// request as message-properties, rather than in the body.
+	//
+	if len(msg.Correlation) > 0 {
+		req.ID = string(msg.Correlation)
+	}
+	if source, ok := msg.Properties["source"]; ok {
+		req.Source = source
+	}
+
 	//
-	//   503 -> Service Unavailable
+	// Continue the server's trace, if it sent one.
 	//
-	result := `HTTP/1.0 503 OK
-Content-type: text/html; charset=UTF-8
-Connection: close
+	ctx := propagator().Extract(context.Background(), propagation.MapCarrier(req.Trace))
+	ctx, span := tracer().Start(ctx, "tunneller.client.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("tunneller.tunnel", t.name),
+			attribute.String("tunneller.request_id", req.ID),
+		))
+	defer span.End()
 
-<!DOCTYPE html>
-<html>
-<body>
-<p>The remote server was unreachable.</p>
-</body>
-</html>`
+	//
+	// Ensure that we understand the request.
+	//
+	if err = compatible(req.Version); err != nil {
+		p.logError("rejected request from server", err, "tunnel", t.name, "id", req.ID)
+		p.reply(t, bus, msg, Response{Version: ProtocolVersion, ID: req.ID, Error: err.Error()})
+		return
+	}
 
 	//
-	// Make the connection to our proxied host.
+	// Decompress the request, if it was compressed.
 	//
-	d := net.Dialer{}
-	con, err := d.Dial("tcp", p.expose)
+	wire := len(req.Request)
+	req.Request, err = decompress(req.Encoding, req.Request)
+	if err != nil {
+		p.logError("failed to decompress request", err, "tunnel", t.name, "id", req.ID)
+		p.reply(t, bus, msg, Response{Version: ProtocolVersion, ID: req.ID, Error: err.Error()})
+		return
+	}
+	t.traffic.addRequest(len(req.Request), wire)
 
 	//
-	// OK we have a default result saved, which shows an error-page.
+	// Make the request to the service we're exposing.
 	//
-	// If we didn't actually get an error then make the actual request,
-	// and update with the response we receive.
+	// If we cannot successfully communicate with it we'll receive
+	// an error-page instead.
 	//
-	if err == nil {
-
-		//
-		// Make the request
-		//
-		con.Write([]byte(req.Request))
-
-		//
-		// Read the reply.
-		//
-		var reply bytes.Buffer
-		io.Copy(&reply, con)
-
-		//
-		// Store the result in our string.
-		//
-		result = reply.String()
+	started := time.Now()
+	result, status, err := t.upstream.fetch(ctx, req.Request)
+	elapsed := time.Since(started)
+	if err != nil {
+		p.logError(fmt.Sprintf("request to %s failed", t.upstream), err, "tunnel", t.name, "id", req.ID)
 	}
+	p.log.Info("request",
+		"tunnel", t.name,
+		"id", req.ID,
+		"request_id", req.RequestID,
+		"ip", req.Source,
+		"status", status,
+		"duration", elapsed)
+	p.metrics.observe(t.name, status, err != nil, elapsed, len(req.Request), len(result))
 
 	//
 	// Now we have either received a real reply from the service
-	// we're exposing, or we've got the fake one we created above.
+	// we're exposing, or we've got an error-page.
 	//
 	// Either way record the request/response, and the HTTP-status
 	// code we received.
 	//
+	req.Response = result
+	t.record(req, status)
 
 	//
-	// The response will have "HTTP/1.x CODE OK..\n"
+	// Send the reply back to the MQ topic for this request, compressed
+	// if the server supports that.
 	//
-	tmp := strings.Split(result, " ")
-	if len(tmp) > 1 {
-		code := tmp[1]
-		p.stats[code]++
+	res := Response{Version: ProtocolVersion, ID: req.ID}
+	res.Response, res.Encoding = encode(p.state.serverCapabilities(), result)
+	t.traffic.addResponse(len(result), len(res.Response))
+	p.reply(t, bus, msg, res)
+}
+
+// onEvent is called when the server sends us an event relating to one of
+// our tunnels.
+func (p *clientCmd) onEvent(t *tunnel, msg *Message) {
+	var event Event
+	if err := json.Unmarshal(msg.Payload, &event); err != nil {
+		p.logError("failed to unmarshal event", err, "tunnel", t.name)
+		return
+	}
+
+	if event.Type == eventRejected {
+		t.traffic.addRejected(event.Reason, event.Count)
+		p.log.Info("requests rejected by the server", "tunnel", t.name, "reason", event.Reason, "count", event.Count)
+	}
+}
+
+// reply publishes the given response to the server, in reply to the
+// given request-message for the given tunnel.
+//
+// If the request specified a response-topic, and correlation-data, we
+// use them.  Otherwise we use the response-topic for the request's ID.
+func (p *clientCmd) reply(t *tunnel, bus Bus, msg *Message, res Response) {
+
+	out, err := json.Marshal(res)
+	if err != nil {
+		p.logError("failed to encode reply", err, "tunnel", t.name, "id", res.ID)
+		return
 	}
 
 	//
-	// Save the response.
+	// We only accept a response-topic beneath our own, so that a
+	// forged request can't make us publish elsewhere.
 	//
-	req.Response = result
+	topic := responseTopic(p.topicPrefix, t.name, res.ID)
+	if msg.ResponseTopic != "" && responseTopicFor(p.topicPrefix, t.name, msg.ResponseTopic) {
+		topic = msg.ResponseTopic
+	}
+
+	err = bus.Publish(&Publication{
+		Topic:       topic,
+		Payload:     out,
+		Correlation: msg.Correlation,
+	})
+	if err != nil {
+		p.logError("failed to publish reply", err, "tunnel", t.name, "id", res.ID)
+	}
+}
+
+// onServerHello is called when the server announces itself.
+//
+// We make sure that we speak the same protocol, and if we don't we
+// record the problem so that the user can see it.
+func (p *clientCmd) onServerHello(bus Bus, msg *Message) {
+
+	if len(msg.Payload) == 0 {
+		return
+	}
+
+	var hello Hello
+	err := json.Unmarshal(msg.Payload, &hello)
+	if err != nil {
+		p.logError("failed to unmarshal server hello", err)
+		return
+	}
+
+	if err = compatible(hello.Version); err != nil {
+		p.logError(fmt.Sprintf("the server is running tunneller %s", hello.Software), err)
+	}
+	p.log.Info("the server announced itself", "state", hello.State, "software", hello.Software)
+	p.state.setServer(hello)
+}
+
+// configure reads our environment variables, and configuration file,
+// setting the flags which weren't given upon the command-line.
+//
+// It returns the tunnels from the configuration file which should be
+// exposed, either those named upon the command-line, or those of the
+// selected profile, along with the names of the flags which were set
+// before the tunnels were read, whose values the tunnels mustn't
+// replace.
+func (p *clientCmd) configure(f *flag.FlagSet) ([]namedTunnel, map[string]bool, error) {
+
+	set := flagsSet(f)
+	if err := applyEnv(f, set); err != nil {
+		return nil, nil, err
+	}
+
+	var cfg clientConfig
+	if err := loadConfig(p.config, !set["config"], &cfg); err != nil {
+		return nil, nil, err
+	}
 
 	//
-	// Add this request to our list of "recent requests".
+	// Find the profile we're to use, if any.
 	//
-	p.requests = append(p.requests, req)
+	name := p.profile
+	if name == "" {
+		name = cfg.Default
+	}
+	var profile clientProfile
+	if name != "" {
+		var ok bool
+		profile, ok = cfg.Profiles[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("the profile %s is not defined in %s", name, p.config)
+		}
+	}
 
 	//
-	// And truncate the list, so that we don't consume all our RAM
-	// keeping everything.
+	// Configure the server we connect to, from the profile.  If
+	// there is only a single server defined we use that.
 	//
-	if len(p.requests) > 5 {
-
-		// Work out how many to trim.
-		trim := len(p.requests) - 5
-
-		// Do the necessary truncation.
-		p.requests = p.requests[trim:]
+	server := profile.Server
+	if server == "" && len(cfg.Servers) == 1 {
+		for key := range cfg.Servers {
+			server = key
+		}
+	}
+	if server != "" {
+		details, ok := cfg.Servers[server]
+		if !ok {
+			return nil, nil, fmt.Errorf("the server %s is not defined in %s", server, p.config)
+		}
+		if err := applyValues(f, set, details.flagValues()); err != nil {
+			return nil, nil, fmt.Errorf("%s: server %s: %s", p.config, server, err.Error())
+		}
 	}
 
 	//
-	// Send the reply back to the MQ topic.
+	// The tunnels named upon the command-line take precedence over
+	// those of the profile, which are only used by default if no
+	// services were given via -expose.
 	//
-	token := client.Publish("clients/"+p.name, 0, false, "X-"+result)
-	token.Wait()
+	names := f.Args()
+	if len(names) == 0 && (p.profile != "" || len(p.expose) == 0) {
+		names = profile.Tunnels
+	}
+
+	var tunnels []namedTunnel
+	for _, ent := range names {
+		details, ok := cfg.Tunnels[ent]
+		if !ok {
+			return nil, nil, fmt.Errorf("the tunnel %s is not defined in %s", ent, p.config)
+		}
+		tunnels = append(tunnels, namedTunnel{name: ent, config: details})
+	}
+	return tunnels, set, nil
 }
 
 // Execute is the entry-point to this sub-command.
@@ -243,10 +636,40 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	//
 	start := time.Now()
 
+	//
+	// Read our configuration.
+	//
+	configured, set, err := p.configure(f)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return 1
+	}
+
+	//
+	// Setup our logger.
+	//
+	var closeLog func()
+	p.log, closeLog, err = p.logOpts.newLogger(io.Discard)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return 1
+	}
+	defer closeLog()
+
+	//
+	// Setup our tracing.
+	//
+	stopTracing, err := setupTracing(p.otlpEndpoint, "tunneller-client", p.log)
+	if err != nil {
+		fmt.Printf("Failed to setup tracing: %s\n", err.Error())
+		return 1
+	}
+	defer stopTracing()
+
 	//
 	// Ensure that we have setup variables
 	//
-	if p.expose == "" {
+	if len(p.expose) == 0 && len(configured) == 0 {
 		fmt.Printf("You must specify the local host:port to expose.\n")
 		return 1
 	}
@@ -254,56 +677,216 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 		fmt.Printf("You must specify the tunnel end-point.\n")
 		return 1
 	}
+	if err = validTopicPrefix(p.topicPrefix); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return 1
+	}
+
+	//
+	// Setup each of the services we're exposing, starting with those
+	// from our configuration file.
+	//
+	seen := make(map[string]bool)
+	for _, ent := range configured {
+		seen[ent.name] = true
+
+		t, tunnelErr := newTunnel(ent.name, ent.config.Expose, ent.config.options(p.upstreamOpts, set), ent.config.tunnelOptions(p.tunnelOpts, set))
+		if tunnelErr != nil {
+			fmt.Printf("Invalid tunnel %s in %s: %s\n", ent.name, p.config, tunnelErr.Error())
+			return 1
+		}
+		p.tunnels = append(p.tunnels, t)
+	}
 
 	//
-	// This is optional, but useful.
+	// A single service given via -expose may be left unnamed, in
+	// which case it takes the name given by -name.  This is optional,
+	// but useful.
 	//
-	if p.name == "" {
-		uid := uuid.NewV4()
-		p.name = uid.String()
+	unnamed := false
+	for _, ent := range p.expose {
+		name, service := splitExpose(ent)
+		if name == "" {
+			if unnamed {
+				fmt.Printf("Only one service may be exposed without a name; use -expose name=host:port\n")
+				return 1
+			}
+			unnamed = true
+
+			name = p.name
+			if name == "" {
+				uid := uuid.NewV4()
+				name = uid.String()
+			}
+		}
+		if seen[name] {
+			fmt.Printf("The name %s is used by more than one service.\n", name)
+			return 1
+		}
+		seen[name] = true
+
+		t, tunnelErr := newTunnel(name, service, p.upstreamOpts, p.tunnelOpts)
+		if tunnelErr != nil {
+			fmt.Printf("Invalid service %s: %s\n", ent, tunnelErr.Error())
+			return 1
+		}
+		p.tunnels = append(p.tunnels, t)
 	}
 
 	//
-	// Setup a map of our HTTP-status code statistics.
+	// We announce ourselves, and identify ourselves to the broker,
+	// via the name of our first tunnel.
 	//
-	p.stats = make(map[string]int)
+	p.name = p.tunnels[0].name
 
 	//
-	// Setup the server-address.
+	// Prepare the messages we use to announce ourselves to the
+	// server, and ensure that it is told if we go away.
 	//
-	opts := MQTT.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s:%d", p.tunnel, p.mqPort))
+	var extra []string
+	if p.mqtt5 {
+		extra = append(extra, capMQTT5)
+	}
+	announce := newHello(stateOnline, extra...)
+	for _, t := range p.tunnels {
+		announce.Tunnels = append(announce.Tunnels, t.info())
+	}
+	hello, err := json.Marshal(announce)
+	if err != nil {
+		fmt.Printf("Failed to encode our hello: %s\n", err.Error())
+		return 1
+	}
+	goodbye, err := json.Marshal(newHello(stateOffline))
+	if err != nil {
+		fmt.Printf("Failed to encode our hello: %s\n", err.Error())
+		return 1
+	}
+
+	opts := BusOptions{
+		Broker:       fmt.Sprintf("%s:%d", p.tunnel, p.mqPort),
+		MQTT5:        p.mqtt5,
+		ClientID:     p.name,
+		Username:     p.mqUsername,
+		Password:     p.mqPassword,
+		ReconnectMax: p.reconnectMax,
+		Will: &Publication{
+			Topic:   helloTopic(p.topicPrefix, p.name),
+			Payload: goodbye,
+			Retain:  true,
+		},
+	}
 
 	//
-	// Set our name.
+	// If our connection is lost we'll automatically reconnect,
+	// recording our state for display.
 	//
-	opts.SetClientID(p.name)
+	opts.OnConnectionLost = func(lostErr error) {
+		p.state.setLost(lostErr)
+		p.log.Warn("lost our connection to MQ", "error", lostErr)
+	}
+	opts.OnReconnecting = func(connErr error) {
+		p.state.setReconnecting(connErr)
+		p.log.Info("reconnecting to MQ", "error", connErr)
+	}
 
 	//
-	// Once we're connected we will subscribe to the named topic.
+	// Once we're connected we will announce ourselves, and then
+	// subscribe to the topic of each of our tunnels.
 	//
-	opts.OnConnect = func(c MQTT.Client) {
+	// Because we use a clean session our subscriptions are lost if
+	// our connection is dropped, so this is invoked again upon every
+	// reconnection.
+	//
+	// NOTE: We can't terminate here, as that would leave the terminal
+	// in a mess, so any error is recorded for display in the GUI.
+	//
+	opts.OnConnect = func(bus Bus) {
 
-		topic := "clients/" + p.name
+		p.state.setConnected()
+		p.log.Info("connected to MQ", "broker", opts.Broker)
 
-		if token := c.Subscribe(topic, 0, p.onMessage); token.Wait() && token.Error() != nil {
-			fmt.Printf("Failed to subscribe to the MQ-topic:%s\n", token.Error())
-			os.Exit(1)
+		if subErr := bus.Subscribe(helloTopic(p.topicPrefix, serverName), p.onServerHello); subErr != nil {
+			p.logError("failed to subscribe to the server's announcements", subErr)
 		}
+
+		//
+		// Announce ourselves to the server, before we accept any
+		// requests, as our announcement tells the server who may
+		// access our tunnels.  If it fails we wait until we next
+		// reconnect.
+		//
+		pubErr := bus.Publish(&Publication{
+			Topic:   helloTopic(p.topicPrefix, p.name),
+			Payload: hello,
+			Retain:  true,
+		})
+		if pubErr != nil {
+			p.logError("failed to announce ourselves", pubErr)
+			return
+		}
+
+		//
+		// Each request is handled in its own goroutine, so that
+		// a slow request doesn't hold up those which follow.
+		//
+		subs := make(map[string]MessageHandler)
+		for _, t := range p.tunnels {
+			subs[requestTopic(p.topicPrefix, t.name)] = func(bus Bus, msg *Message) {
+				go p.onMessage(t, bus, msg)
+			}
+			subs[eventsTopic(p.topicPrefix, t.name)] = func(bus Bus, msg *Message) {
+				p.onEvent(t, msg)
+			}
+		}
+		for topic, handler := range subs {
+			if subErr := bus.Subscribe(topic, handler); subErr != nil {
+				p.logError(fmt.Sprintf("failed to subscribe to the MQ-topic %s", topic), subErr)
+			}
+		}
+	}
+
+	//
+	// Serve our metrics, if we've been asked to.
+	//
+	if p.metricsAddr != "" {
+		listener, listenErr := net.Listen("tcp", p.metricsAddr)
+		if listenErr != nil {
+			fmt.Printf("Failed to serve metrics upon %s: %s\n", p.metricsAddr, listenErr.Error())
+			return 1
+		}
+		p.metrics = newClientMetrics()
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", p.metrics.handler())
+		go func() {
+			srv := &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+			if serveErr := srv.Serve(listener); serveErr != nil {
+				p.logError("failed to serve metrics", serveErr)
+			}
+		}()
 	}
 
 	//
 	// Actually establish the MQ connection.
 	//
-	client := MQTT.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Printf("Failed to connect to the MQ-host %s\n", token.Error())
+	bus, err := NewBus(opts)
+	if err != nil {
+		fmt.Printf("Failed to connect to the MQ-host %s\n", err.Error())
 		return 1
 	}
+	defer func() {
+		bus.Publish(&Publication{
+			Topic:   helloTopic(p.topicPrefix, p.name),
+			Payload: goodbye,
+			Retain:  true,
+		})
+		bus.Disconnect()
+	}()
 
 	//
 	// Setup our GUI
 	//
-	if err := ui.Init(); err != nil {
+	if err = ui.Init(); err != nil {
 		log.Fatalf("failed to initialize termui: %v", err)
 	}
 	defer ui.Close()
@@ -318,18 +901,30 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	//
 	p11 := widgets.NewParagraph()
 	p11.Title = "Keyboard Control"
-	p11.Text = "\n  Press q to quit\n  Press h or l to switch tabs, or use the arrow-keys\n\n"
-	p11.SetRect(0, 3, termWidth, 9)
+	p11.Text = "\n  Press q to quit\n  Press h or l to switch tabs, or use the arrow-keys\n"
+	if len(p.tunnels) > 1 {
+		p11.Text += "  Press t to switch between tunnels upon the statistics tab\n"
+	}
+	p11.Text += "\n"
+	bottom := 3 + strings.Count(p11.Text, "\n") + 2
+	p11.SetRect(0, 3, termWidth, bottom)
 	p11.BorderStyle.Fg = ui.ColorYellow
 
 	//
 	// Page 1 - widget 2 - access
 	//
+	// We show the URL of each of our tunnels, and the service it
+	// proxies content from.
+	//
 	p12 := widgets.NewParagraph()
 	p12.Title = "Remote Access"
-	p12.Text += "\n  http://" + p.name + "." + p.tunnel + "\n\n"
-	p12.Text += "  Will proxy content from " + p.expose
-	p12.SetRect(0, 10, termWidth, 17)
+	p12.Text = "\n"
+	for _, t := range p.tunnels {
+		p12.Text += "  http://" + t.name + "." + p.tunnel + " will proxy content from " + t.upstream.String() + "\n"
+	}
+	top := bottom + 1
+	bottom = top + len(p.tunnels) + 4
+	p12.SetRect(0, top, termWidth, bottom)
 	p12.BorderStyle.Fg = ui.ColorYellow
 
 	//
@@ -338,14 +933,32 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	p13 := widgets.NewParagraph()
 	p13.Title = "Uptime"
 	p13.Text += "\n  00:00:00"
-	p13.SetRect(0, 18, termWidth, 23)
+	top = bottom + 1
+	bottom = top + 5
+	p13.SetRect(0, top, termWidth, bottom)
 	p13.BorderStyle.Fg = ui.ColorYellow
 
+	//
+	// Page 1 - widget 4 - connection state
+	//
+	p14 := widgets.NewParagraph()
+	p14.Title = "Connection"
+	p14.Text = p.state.String()
+	top = bottom + 1
+	p14.SetRect(0, top, termWidth, top+8)
+	p14.BorderStyle.Fg = ui.ColorYellow
+
+	//
+	// The second page shows the statistics of a single tunnel at a
+	// time, which may be changed by pressing "t".
+	//
+	current := 0
+
 	//
 	// Page 2 - widget 1 - response-codes
 	//
 	p21 := widgets.NewBarChart()
-	p21.Title = "HTTP Responses"
+	p21.Title = "HTTP Responses - " + p.tunnels[current].name
 	p21.SetRect(0, 3, termWidth, termHeight/2)
 
 	//
@@ -353,85 +966,53 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 	//
 	p22 := widgets.NewTable()
 	p22.Rows = [][]string{
-		[]string{"IP Address", "Status", "Request"},
+		[]string{"IP Address", "Request ID", "Status", "Request"},
 	}
 	p22.TextStyle = ui.NewStyle(ui.ColorWhite)
-	p22.SetRect(0, (termHeight/2)+1, termWidth, termHeight-3)
-	p22.ColumnWidths = []int{20, 8, termWidth - 28}
+	p22.SetRect(0, (termHeight/2)+1, termWidth, termHeight-8)
+	p22.ColumnWidths = requestColumns(termWidth, 15)
+
+	//
+	// Page 2 - widget 3 - compression
+	//
+	p23 := widgets.NewParagraph()
+	p23.Title = "Traffic - " + p.tunnels[current].name
+	p23.Text = p.tunnels[current].traffic.String()
+	p23.SetRect(0, termHeight-7, termWidth, termHeight-1)
 
 	//
-	// Show our "uptime"
+	// Show our "uptime", and the state of our connection.
 	//
 	updateInfo := func() {
 
-		const (
-			Decisecond = 100 * time.Millisecond
-			Day        = 24 * time.Hour
-		)
-		ts := time.Since(start)
+		p13.Text = "\n  " + formatDuration(time.Since(start))
+		ui.Render(p13)
 
-		sign := time.Duration(1)
-		if ts < 0 {
-			sign = -1
-			ts = -ts
-		}
-		ts += +Decisecond / 2
-		d := sign * (ts / Day)
-		ts = ts % Day
-		h := ts / time.Hour
-		ts = ts % time.Hour
-		m := ts / time.Minute
-		ts = ts % time.Minute
-		s := ts / time.Second
-
-		if d > 0 {
-			if d == 1 {
-				p13.Text = fmt.Sprintf("%02d day %02d:%02d:%02d", d, h, m, s)
-			} else {
-
-				p13.Text = fmt.Sprintf("%02d days %02d:%02d:%02d", d, h, m, s)
-			}
-		} else {
-			p13.Text = fmt.Sprintf("%02d:%02d:%02d", h, m, s)
+		p14.Text = p.state.String()
+		p14.BorderStyle.Fg = ui.ColorYellow
+		if !p.state.isConnected() || p.state.serverStopping() {
+			p14.BorderStyle.Fg = ui.ColorRed
 		}
-
-		p13.Text = "\n  " + p13.Text
-		ui.Render(p13)
+		ui.Render(p14)
 	}
 
 	//
 	// Update the graph / table in the second page.
 	//
 	updateResponse := func() {
-		//
-		// We want to show all the distinct status-codes.
-		//
-		var statsData []float64
-		var statsLabel []string
 
-		//
-		// We want to sort the keys, so that HTTP-status codes
-		// are shown in a logical order.
-		//
-		var tmp []string
-		for k := range p.stats {
-			tmp = append(tmp, k)
-		}
-		sort.Strings(tmp)
+		t := p.tunnels[current]
 
 		//
-		// Update.
+		// We want to show all the distinct status-codes, which
+		// are sorted so that they're shown in a logical order.
 		//
-		for _, code := range tmp {
-			if p.stats[code] > 0 {
-				statsLabel = append(statsLabel, code)
-				statsData = append(statsData, float64(p.stats[code]))
-			}
-		}
+		statsLabel, statsData, requests := t.snapshot()
 
 		//
 		// Update the graph and render it.
 		//
+		p21.Title = "HTTP Responses - " + t.name
 		p21.Labels = statsLabel
 		p21.Data = statsData
 		ui.Render(p21)
@@ -439,9 +1020,17 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 		//
 		// Now update the table.
 		//
+		// The addresses of our visitors might be IPv6, so we
+		// widen their column as required.
+		//
+		ipWidth := 15
 		var rows [][]string
-		rows = append(rows, []string{"IP Address", "Status", "Request"})
-		for _, ent := range p.requests {
+		rows = append(rows, []string{"IP Address", "Request ID", "Status", "Request"})
+		for _, ent := range requests {
+
+			if len(ent.Source)+1 > ipWidth {
+				ipWidth = len(ent.Source) + 1
+			}
 
 			//
 			// The response is "HTTP XXX BLAH\n.."
@@ -450,7 +1039,7 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 			//
 			// Save the first line in "tmp".
 			//
-			resLines := strings.Split(ent.Response, "\n")
+			resLines := strings.Split(string(ent.Response), "\n")
 			tmp := "HTTP -1 OK"
 			if len(resLines) > 0 {
 				tmp = resLines[0]
@@ -467,16 +1056,24 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 			//
 			// The request will be a multi-line thing.
 			//
-			request := ent.Request
+			request := string(ent.Request)
 			reqRows := strings.Split(request, "\n")
 			if len(reqRows) > 0 {
 				request = reqRows[0]
 			}
 
-			rows = append(rows, []string{ent.Source, tmp, request})
+			rows = append(rows, []string{ent.Source, ent.RequestID, tmp, request})
 		}
 		p22.Rows = rows
+		p22.ColumnWidths = requestColumns(termWidth, ipWidth)
 		ui.Render(p22)
+
+		//
+		// Finally update our traffic statistics.
+		//
+		p23.Title = "Traffic - " + t.name
+		p23.Text = t.traffic.String()
+		ui.Render(p23)
 	}
 
 	//
@@ -495,19 +1092,19 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 			//
 			// First tab-pane.
 			//
-			ui.Render(p11, p12, p13)
+			ui.Render(p11, p12, p13, p14)
 		case 1:
 			//
 			// Second tab-pane.
 			//
-			ui.Render(p21, p22)
+			ui.Render(p21, p22, p23)
 		}
 	}
 
 	//
 	// Default to the first tab.
 	//
-	ui.Render(tabpane, p11, p12, p13)
+	ui.Render(tabpane, p11, p12, p13, p14)
 
 	//
 	// Ensure we can poll for events.
@@ -542,6 +1139,14 @@ func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 				ui.Render(tabpane)
 				renderTab()
 
+			case "t":
+				current = (current + 1) % len(p.tunnels)
+				if tabpane.ActiveTabIndex == 1 {
+					ui.Clear()
+					ui.Render(tabpane)
+					updateResponse()
+				}
+
 			case "<Resize>":
 				//
 				// This just resizes the outline around the tab
@@ -6,9 +6,10 @@
 //
 // When a request comes in for the host "foo.tunnel.example.com"
 //
-//  1. We squirt the incoming request down the MQ topic clients/foo.
+//  1. We squirt the incoming request down the MQ topic clients/foo/req.
 //
-//  2. We then await a reply, for up to 10 seconds.
+//  2. We then await a reply, for up to 10 seconds by default, upon the
+//     topic clients/foo/resp/$id.
 //
 //       If we receive it great.
 //       Otherwise we return an error.
@@ -17,18 +18,34 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/subcommands"
+	"github.com/pires/go-proxyproto"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //
@@ -39,13 +56,111 @@ type serveCmd struct {
 	bindHost string
 
 	// MQ conneciton
-	mq MQTT.Client
+	mq Bus
 
 	// the port we bind upon
 	bindPort int
 
 	// The port MQ listens upon
 	mqPort int
+
+	// The credentials to connect to MQ with
+	mqUsername string
+	mqPassword string
+
+	// The configuration file we read
+	config string
+
+	// settings holds the reloadable parts of our configuration,
+	// which are replaced when we receive SIGHUP.
+	settings atomic.Pointer[serverSettings]
+
+	// The prefix for our MQ topics
+	topicPrefix string
+
+	// Should we speak MQTT 5 to the broker?
+	mqtt5 bool
+
+	// How long we wait for a client to reply
+	timeout time.Duration
+
+	// How long we wait for in-flight requests to complete when we're
+	// shutting down
+	drainTimeout time.Duration
+
+	// The address our admin listener binds upon, if any
+	admin string
+
+	// connected is true while we're connected to MQ, and subscribed
+	// is true once we've subscribed to the topics our dispatcher
+	// relies upon.
+	connected  atomic.Bool
+	subscribed atomic.Bool
+
+	// stopping is true once we've begun to shut down.
+	stopping atomic.Bool
+
+	// metrics holds the metrics we export via our admin listener.
+	metrics *serverMetrics
+
+	// The options for our logging, and our logger
+	logOpts logOptions
+	log     *slog.Logger
+
+	// The options for our access log, and the log itself
+	accessLogPath    string
+	accessLogFormat  string
+	accessLogMaxSize int64
+	accessLogBackups int
+	accessLog        *accessLog
+
+	// proxyProtocol is true if we accept PROXY protocol headers from
+	// our trusted proxies.
+	proxyProtocol bool
+
+	// otlpEndpoint is the address of the collector we export our
+	// spans to, if any.
+	otlpEndpoint string
+
+	// pending holds the requests which are awaiting a reply, keyed
+	// by their ID.
+	//
+	// Replies from all clients are received by a single subscription,
+	// and dispatched to the appropriate channel.
+	pending map[string]chan Response
+
+	// pendingLock protects our pending-map.
+	pendingLock sync.Mutex
+
+	// clients holds the Hello messages announced by our clients,
+	// keyed by the name of each tunnel they expose.
+	clients map[string]Hello
+
+	// announced holds the names of the tunnels each client exposes,
+	// keyed by the name it announced itself under, so that they can
+	// be forgotten when it goes away.
+	announced map[string][]string
+
+	// owners holds the name of the client which exposes each tunnel.
+	owners map[string]string
+
+	// access holds the access-list each tunnel announced, if any.
+	access map[string]accessList
+
+	// rejected holds the number of requests to each tunnel which
+	// we've rejected, by reason, since we last told its client.
+	rejected map[string]map[string]int
+
+	// rejectedLock protects our rejected-map.
+	rejectedLock sync.Mutex
+
+	// passwords remembers the passwords of the visitors we've
+	// authenticated.
+	passwords passwordCache
+
+	// clientsLock protects our clients, announced, owners, and access
+	// maps.
+	clientsLock sync.Mutex
 }
 
 // Name returns the name of this sub-command.
@@ -58,6 +173,11 @@ func (p *serveCmd) Synopsis() string { return "Launch the HTTP server." }
 func (p *serveCmd) Usage() string {
 	return `serve [options]:
   Launch the HTTP server for proxying via our MQ-connection to the clients.
+
+  Any flag may also be set via an environment variable, for example
+  -mq-port via $TUNNELLER_MQ_PORT.  Sending SIGHUP reloads the domains,
+  access-lists, trusted-proxies, htpasswd, rate-limits and error-templates
+  from the -config file.
 `
 }
 
@@ -65,39 +185,502 @@ func (p *serveCmd) Usage() string {
 func (p *serveCmd) SetFlags(f *flag.FlagSet) {
 	f.IntVar(&p.bindPort, "port", 8080, "The port to bind upon.")
 	f.IntVar(&p.mqPort, "mq-port", 1883, "The MQ port.")
-	f.StringVar(&p.bindHost, "host", "127.0.0.1", "The IP to listen upon.")
+	f.StringVar(&p.bindHost, "host", "127.0.0.1", "The IP, or a comma-separated list of IPs, to listen upon.")
+	f.StringVar(&p.mqUsername, "mq-username", "", "The username to authenticate to MQ with.")
+	f.StringVar(&p.mqPassword, "mq-password", "", "The password to authenticate to MQ with.")
+	f.StringVar(&p.config, "config", "", "The configuration file to read.")
+	p.logOpts.SetFlags(f, false)
+	f.StringVar(&p.accessLogPath, "access-log", "", "The file to record each request in, if any.")
+	f.StringVar(&p.accessLogFormat, "access-log-format", "combined", "The format of the access log: combined, or json.")
+	f.Int64Var(&p.accessLogMaxSize, "access-log-max-size", 100, "The size, in megabytes, at which the access log is rotated; 0 disables rotation.")
+	f.IntVar(&p.accessLogBackups, "access-log-backups", 5, "The number of rotated access logs to keep.")
+	f.StringVar(&p.admin, "admin", "", "The host:port to serve /healthz, /readyz and /metrics upon, if any.")
+	f.BoolVar(&p.proxyProtocol, "proxy-protocol", false, "Accept PROXY protocol headers, from the trusted-proxies in the -config file.")
+	f.StringVar(&p.otlpEndpoint, "otlp-endpoint", "", "The URL of the OpenTelemetry collector to export traces to, if any.")
+	f.StringVar(&p.topicPrefix, "topic-prefix", defaultTopicPrefix, "The prefix for our MQ topics.")
+	f.BoolVar(&p.mqtt5, "mqtt5", false, "Speak MQTT 5, rather than MQTT 3.1.1, to the broker.")
+	f.DurationVar(&p.timeout, "timeout", 10*time.Second, "How long to wait for a client to reply.")
+	f.DurationVar(&p.drainTimeout, "drain-timeout", 30*time.Second, "How long to wait for in-flight requests to complete when shutting down.")
+}
+
+//
+// await registers a pending request, returning the channel upon which
+// the reply will be delivered.
+//
+func (p *serveCmd) await(id string) chan Response {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+
+	ch := make(chan Response, 1)
+	p.pending[id] = ch
+	return ch
+}
+
+//
+// forget removes a pending request, once it has been answered or has
+// timed out.
+//
+func (p *serveCmd) forget(id string) {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+
+	delete(p.pending, id)
+}
+
+//
+// onResponse is invoked when a reply is received from any client.
+//
+// We look up the pending request via its ID, and deliver the reply to it.
+// Replies to requests we didn't make, or which have already timed out,
+// are ignored.
+//
+// The ID is taken from the correlation-data, if the client speaks MQTT 5,
+// otherwise from the topic.
+//
+func (p *serveCmd) onResponse(bus Bus, msg *Message) {
+	id := responseID(msg.Topic)
+	if len(msg.Correlation) > 0 {
+		id = string(msg.Correlation)
+	}
+
+	var res Response
+	err := json.Unmarshal(msg.Payload, &res)
+	if err != nil {
+		p.log.Warn("failed to unmarshal reply", "id", id, "error", err)
+		return
+	}
+
+	p.pendingLock.Lock()
+	ch, ok := p.pending[id]
+	delete(p.pending, id)
+	p.pendingLock.Unlock()
+
+	if ok {
+		ch <- res
+	}
+}
+
+//
+// onHello is invoked when a client announces itself, or when its
+// announcement is removed because it has disconnected.
+//
+// A client may expose several tunnels, which it lists in its hello.  If
+// it lists none then it exposes a single tunnel, under the name it
+// announced itself with.
+//
+func (p *serveCmd) onHello(bus Bus, msg *Message) {
+	name := helloName(msg.Topic)
+	if name == serverName {
+		return
+	}
+
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+
+	//
+	// Forget the tunnels from any previous announcement.
+	//
+	for _, tunnel := range p.announced[name] {
+		if p.owners[tunnel] == name {
+			delete(p.clients, tunnel)
+			delete(p.owners, tunnel)
+			delete(p.access, tunnel)
+		}
+	}
+	delete(p.announced, name)
+
+	//
+	// An empty message means the announcement was removed.
+	//
+	if len(msg.Payload) == 0 {
+		return
+	}
+
+	var hello Hello
+	err := json.Unmarshal(msg.Payload, &hello)
+	if err != nil {
+		p.log.Warn("failed to unmarshal hello", "client", name, "error", err)
+		return
+	}
+
+	//
+	// Forget about clients which have gone away.
+	//
+	if hello.State != stateOnline {
+		return
+	}
+	if err = compatible(hello.Version); err != nil {
+		p.log.Warn("incompatible client", "client", name, "software", hello.Software, "error", err)
+	}
+
+	tunnels := []string{name}
+	if len(hello.Tunnels) > 0 {
+		tunnels = nil
+		for _, ent := range hello.Tunnels {
+			if validTopicName(ent.Name) != nil {
+				p.log.Warn("invalid tunnel name announced", "client", name, "tunnel", ent.Name)
+				continue
+			}
+			tunnels = append(tunnels, ent.Name)
+		}
+	}
+
+	for _, tunnel := range tunnels {
+		if owner, ok := p.owners[tunnel]; ok && owner != name {
+			p.log.Warn("tunnel taken over", "client", name, "tunnel", tunnel, "previous", owner)
+		}
+		p.clients[tunnel] = hello
+		p.owners[tunnel] = name
+
+		//
+		// If the tunnel's access-list is invalid we deny everybody,
+		// rather than allowing those it was meant to deny.
+		//
+		info := hello.tunnel(tunnel)
+		access, accessErr := newAccessList(info.Allow, info.Deny)
+		if accessErr != nil {
+			p.log.Warn("invalid access-list announced", "client", name, "tunnel", tunnel, "error", accessErr)
+			access = denyAll()
+		}
+		p.access[tunnel] = access
+	}
+	p.announced[name] = tunnels
+}
+
+//
+// tunnelAccess returns the access-list announced for the named tunnel.
+//
+// Requests to tunnels which haven't been announced are refused before
+// this is consulted, but should one slip through we deny everybody.
+//
+func (p *serveCmd) tunnelAccess(name string) accessList {
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+
+	access, ok := p.access[name]
+	if !ok {
+		return denyAll()
+	}
+	return access
+}
+
+//
+// reject records that a request to the named tunnel was rejected for the
+// given reason.
+//
+// The client which exposes the tunnel is told how many of its requests
+// were rejected periodically, by reportRejections, rather than once for
+// each, so that a flood of rejected requests doesn't become a flood of
+// messages to the client.
+//
+func (p *serveCmd) reject(name string, reason string) {
+	p.metrics.rejected.WithLabelValues(p.tunnelLabel(name), reason).Inc()
+
+	if _, ok := p.client(name); !ok {
+		return
+	}
+
+	p.rejectedLock.Lock()
+	defer p.rejectedLock.Unlock()
+
+	if p.rejected[name] == nil {
+		p.rejected[name] = make(map[string]int)
+	}
+	p.rejected[name][reason]++
+}
+
+//
+// reportRejections tells each client how many of its requests have been
+// rejected, at the given interval, until the given context is done.
+//
+func (p *serveCmd) reportRejections(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		p.rejectedLock.Lock()
+		rejected := p.rejected
+		p.rejected = make(map[string]map[string]int)
+		p.rejectedLock.Unlock()
+
+		for name, reasons := range rejected {
+			for reason, count := range reasons {
+				payload, err := json.Marshal(Event{
+					Version: ProtocolVersion,
+					Type:    eventRejected,
+					Reason:  reason,
+					Count:   count,
+				})
+				if err != nil {
+					p.log.Error("failed to encode the event as JSON", "tunnel", name, "error", err)
+					continue
+				}
+				err = p.mq.Publish(&Publication{Topic: eventsTopic(p.topicPrefix, name), Payload: payload})
+				if err != nil {
+					p.log.Error("failed to publish the event", "tunnel", name, "error", err)
+				}
+			}
+		}
+	}
+}
+
+//
+// client returns the Hello message announced by the client exposing the
+// named tunnel, if any.
+//
+func (p *serveCmd) client(name string) (Hello, bool) {
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+
+	hello, ok := p.clients[name]
+	return hello, ok
+}
+
+//
+// loadConfig reads our configuration file, if we have one.
+//
+func (p *serveCmd) loadConfig() (serverConfig, error) {
+	var cfg serverConfig
+	if p.config == "" {
+		return cfg, nil
+	}
+	err := loadConfig(p.config, false, &cfg)
+	return cfg, err
+}
+
+//
+// reload re-reads the reloadable parts of our configuration.
+//
+// If the configuration is invalid the error is returned, and the current
+// configuration remains in use.
+//
+func (p *serveCmd) reload() error {
+	cfg, err := p.loadConfig()
+	if err != nil {
+		return err
+	}
+	settings, err := newServerSettings(cfg)
+	if err != nil {
+		return err
+	}
+	if p.proxyProtocol && len(settings.trusted) == 0 {
+		return fmt.Errorf("-proxy-protocol requires the trusted-proxies to be listed")
+	}
+	p.settings.Store(settings)
+	return nil
 }
 
 //
 // RemoteIP retrieves the remote IP address of the requesting HTTP-client.
 //
+// If the request was made via one of the given trusted proxies we use
+// the X-Forwarded-For header, taking the last address within it which
+// isn't that of a trusted proxy.  Otherwise the header could be forged,
+// and we ignore it.
+//
 // This is sent to the client, for logging purposes.
 //
-func RemoteIP(request *http.Request) string {
+func RemoteIP(request *http.Request, trusted []*net.IPNet) string {
+
+	ip := parseAddress(request.RemoteAddr)
+	if ip == "" {
+		ip = request.RemoteAddr
+	}
 
 	//
-	// Get the X-Forwarded-For header, if present.
+	// Unless we received the request from a proxy we trust we
+	// use the remote address directly.
 	//
-	xForwardedFor := request.Header.Get("X-Forwarded-For")
+	if !containsIP(trusted, net.ParseIP(ip)) {
+		return ip
+	}
 
 	//
-	// No forwarded IP?  Then use the remote address directly.
+	// Walk the proxies the request passed through, from the one
+	// nearest to us, until we find one we don't trust.
 	//
-	if xForwardedFor == "" {
-		ip, _, _ := net.SplitHostPort(request.RemoteAddr)
-		return ip
+	var entries []string
+	for _, value := range request.Header.Values("X-Forwarded-For") {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		address := parseAddress(entries[i])
+		if address == "" {
+			continue
+		}
+
+		ip = address
+		if !containsIP(trusted, net.ParseIP(ip)) {
+			break
+		}
+	}
+
+	return (ip)
+}
+
+//
+// proxyPolicy decides whether we believe the PROXY protocol header sent
+// upon a connection, which we only do if it was made by one of our trusted
+// proxies.  Connections from others which send a header are rejected.
+//
+// The real address of the visitor is then used as the remote address of
+// the requests made upon the connection.
+//
+func (p *serveCmd) proxyPolicy(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+	ip := parseAddress(opts.Upstream.String())
+	if containsIP(p.settings.Load().trusted, net.ParseIP(ip)) {
+		return proxyproto.USE, nil
+	}
+	return proxyproto.REJECT, nil
+}
+
+//
+// parseAddress returns the IP address within the given value, which may be
+// either an IPv4 or IPv6 address, optionally followed by a port, in which
+// case an IPv6 address is bracketed, i.e. "192.0.2.1:80", "2001:db8::1",
+// or "[2001:db8::1]:80".  An IPv4 address mapped into IPv6 is returned in
+// its IPv4 form, and the zone of an IPv6 address is dropped.
+//
+// If the value doesn't contain an address we return an empty string.
+//
+func parseAddress(value string) string {
+	value = strings.TrimSpace(value)
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		if host, _, splitErr := net.SplitHostPort(value); splitErr == nil {
+			value = host
+		}
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+		addr, err = netip.ParseAddr(value)
+		if err != nil {
+			return ""
+		}
+	}
+	return addr.Unmap().WithZone("").String()
+}
+
+//
+// listenAddress returns the network, and address, upon which we listen
+// for the given host and port.
+//
+// IPv4 addresses are bound via tcp4, and IPv6 addresses via tcp6, and
+// the latter may be given within brackets, as in "[::1]".
+//
+func listenAddress(host string, port int) (string, string) {
+	host = strings.TrimSpace(host)
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	network := "tcp"
+	if addr, err := netip.ParseAddr(host); err == nil {
+		network = "tcp6"
+		if addr.Is4() || addr.Is4In6() {
+			network = "tcp4"
+			addr = addr.Unmap()
+		}
+		host = addr.String()
+	}
+	return network, net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+//
+// requestIDHeader is the header which holds the ID of a request.
+//
+const requestIDHeader = "X-Request-ID"
+
+//
+// validRequestID returns true if the given request-ID, received from a
+// visitor, is acceptable.  We require a short string of printable ASCII,
+// so that it can't be used to mangle our logs.
+//
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// dumpRequest converts the given request to plain-text, in the HTTP/1.1
+// form which our clients parse.
+//
+// Visitors using HTTP/2 needn't state the length of their request's body,
+// as the HTTP/2 framing delimits it instead, but that framing is lost when
+// the request is dumped.  So we buffer such bodies and state their length,
+// leaving the original request untouched.
+//
+func dumpRequest(r *http.Request) ([]byte, error) {
+	out := r.Clone(r.Context())
+	if r.ProtoMajor != 1 {
+		out.Proto, out.ProtoMajor, out.ProtoMinor = "HTTP/1.1", 1, 1
 	}
 
-	entries := strings.Split(xForwardedFor, ",")
-	address := strings.TrimSpace(entries[0])
+	chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+	if r.ProtoMajor != 1 || (r.ContentLength < 0 && !chunked) {
+		out.TransferEncoding = nil
+		out.Header.Del("Transfer-Encoding")
 
-	// Remove the port - TODO: IPv6.
-	if strings.Contains(address, ":") {
-		tmp := strings.Split(address, ":")
-		address = tmp[0]
+		if r.Body != nil && r.Body != http.NoBody {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			out.Body = io.NopCloser(bytes.NewReader(body))
+			out.ContentLength = int64(len(body))
+		} else {
+			out.ContentLength = 0
+		}
+
+		out.Header.Del("Content-Length")
+		if out.ContentLength > 0 {
+			out.Header.Set("Content-Length", strconv.FormatInt(out.ContentLength, 10))
+		}
 	}
 
-	return (address)
+	return httputil.DumpRequest(out, true)
+}
+
+//
+// requestInfo holds the details of a request which are determined as it
+// is handled, and which are logged once it has been.
+//
+type requestInfo struct {
+	// tunnel is the name of the tunnel the request was made to.
+	tunnel string
+
+	// id is the ID the request was given.
+	id string
+
+	// requestID is the value of the request's X-Request-ID header.
+	requestID string
+}
+
+//
+// requestInfoKey is the key under which a request's requestInfo is
+// stored within its context.
+//
+type requestInfoKey struct{}
+
+//
+// infoFor returns the requestInfo of the given request.
+//
+func infoFor(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
 }
 
 //
@@ -108,126 +691,265 @@ func RemoteIP(request *http.Request) string {
 func (p *serveCmd) HTTPHandler(w http.ResponseWriter, r *http.Request) {
 
 	//
-	// See which vhost the connection was sent to, we assume that
-	// the variable part will be the start of the hostname, which will
-	// be split by "."
+	// Use the settings which are current as we start, so that they
+	// don't change beneath us if they're reloaded.
+	//
+	settings := p.settings.Load()
+
+	//
+	// See which vhost the connection was sent to.  Unless the host
+	// is mapped to a tunnel, we assume that the variable part will
+	// be the start of the hostname, which will be split by "."
 	//
 	// i.e. "foo.tunnel.steve.fi" has a name of "foo".
 	//
-	host := r.Host
-	if strings.Contains(host, ".") {
-		hsts := strings.Split(host, ".")
-		host = hsts[0]
+	host := settings.tunnelFor(r.Host)
+
+	info := infoFor(r)
+	info.tunnel = host
+
+	//
+	// Find the address of the visitor.
+	//
+	ip := RemoteIP(r, settings.trusted)
+
+	//
+	// Ensure the request has an ID which the visitor, the service
+	// we're exposing, and their operators can all refer to it by.
+	//
+	// We accept the visitor's own ID, if it is sane.
+	//
+	requestID := r.Header.Get(requestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = uuid.NewV4().String()
 	}
+	r.Header.Set(requestIDHeader, requestID)
+	w.Header().Set(requestIDHeader, requestID)
+	info.requestID = requestID
 
 	//
-	// Dump the request to plain-text.
+	// Start the span covering our handling of this request, which
+	// continues the visitor's trace if they sent one.
 	//
-	requestDump, err := httputil.DumpRequest(r, true)
-	fmt.Printf("Sending request to remote name %s\n", host)
-	if err != nil {
-		fmt.Fprintf(w, "Error converting the incoming request to plain-text: %s\n", err.Error())
-		fmt.Printf("Error converting the incoming request to plain-text: %s\n", err.Error())
+	ctx := propagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, "tunneller.server.receive",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("tunneller.tunnel", host),
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		))
+	defer span.End()
+
+	//
+	// The name must be usable as part of an MQ topic.
+	//
+	if err := validTopicName(host); err != nil {
+		settings.errorPage(w, http.StatusBadRequest, host, err.Error())
+		p.log.Info("invalid tunnel name", "tunnel", host, "ip", ip, "error", err)
 		return
 	}
 
 	//
-	// This is the structure we'll send to the client.
+	// Ensure the visitor is permitted by the server.
 	//
-	var req Request
+	if !settings.permitted(ip) {
+		settings.errorPage(w, http.StatusForbidden, host, "Access denied.")
+		p.log.Info("denied access", "tunnel", host, "ip", ip)
+		p.reject(host, rejectServer)
+		return
+	}
 
 	//
-	// Add the actual request.
+	// The client must have announced the tunnel, as that tells us
+	// who may access it, and make sure we can talk to it.
 	//
-	req.Request = string(requestDump)
+	hello, known := p.client(host)
+	if !known {
+		settings.errorPage(w, http.StatusServiceUnavailable, host,
+			fmt.Sprintf("The tunnel '%s' isn't connected.", host))
+		p.log.Info("request to an unannounced tunnel", "tunnel", host, "ip", ip)
+		return
+	}
+	if err := compatible(hello.Version); err != nil {
+		settings.errorPage(w, http.StatusBadGateway, host,
+			fmt.Sprintf("The tunnel '%s' cannot be used with this server.", host))
+		p.log.Warn("incompatible client", "tunnel", host, "software", hello.Software, "error", err)
+		return
+	}
 
 	//
-	// Add the source-IP from which it was received.
+	// Ensure the visitor is permitted by the tunnel, and isn't
+	// making too many requests.
+	//
+	if !p.tunnelAccess(host).permitted(ip) {
+		settings.errorPage(w, http.StatusForbidden, host, "Access denied.")
+		p.log.Info("denied access by the tunnel", "tunnel", host, "ip", ip)
+		p.reject(host, rejectTunnel)
+		return
+	}
+	if !settings.allowRequest(p.tunnelLabel(host)) {
+		settings.errorPage(w, http.StatusTooManyRequests, host, "Too many requests, please try again later.")
+		p.log.Info("rate-limited request", "tunnel", host, "ip", ip)
+		p.reject(host, rejectRateLimit)
+		return
+	}
+
 	//
-	req.Source = RemoteIP(r)
+	// If the tunnel, or the server, is protected by a password then
+	// the visitor must authenticate.  Their credentials are removed
+	// so that they don't reach the service.
+	//
+	users := hello.tunnel(host).Users
+	if len(users) > 0 || len(settings.users) > 0 {
+		user, ok := p.passwords.authenticate(r, users, settings.users)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Basic realm="+quoteForwarded(host)+", charset=\"UTF-8\"")
+			settings.errorPage(w, http.StatusUnauthorized, host, "Authentication required.")
+			p.log.Info("unauthorized request", "tunnel", host, "ip", ip, "user", user)
+			return
+		}
+		r.Header.Del("Authorization")
+	}
 
 	//
-	// Convert the structure to a JSON message, so we can send it down
-	// the queue.
+	// Tell the service who made the request, and how, via the
+	// headers the tunnel asked for.
 	//
-	toSend, err := json.Marshal(req)
+	setForwardedHeaders(r, hello.tunnel(host).Forwarded, settings.trusted)
 
+	//
+	// Dump the request to plain-text.
+	//
+	requestDump, err := dumpRequest(r)
 	if err != nil {
-		fmt.Fprintf(w, "Error encoding the request as JSON: %s\n", err.Error())
-		fmt.Printf("Error encoding the request as JSON: %s\n", err.Error())
+		settings.errorPage(w, http.StatusBadGateway, host, "The request could not be forwarded.")
+		p.log.Error("failed to convert the request to plain-text", "tunnel", host, "error", err)
 		return
 	}
 
 	//
-	// Publish the JSON object to the topic that we believe the client
-	// will be listening upon.
+	// This is the structure we'll send to the client.
 	//
-	token := p.mq.Publish("clients/"+host, 0, false, string(toSend))
-	token.Wait()
+	var req Request
+	req.Version = ProtocolVersion
 
 	//
-	// The (complete) response from the client will be placed here.
+	// Give the request a unique ID, which the client will use
+	// to tell us where to send the reply.
 	//
-	response := ""
+	req.ID = uuid.NewV4().String()
+	info.id = req.ID
+	req.RequestID = requestID
+	span.SetAttributes(attribute.String("tunneller.request_id", requestID))
 
 	//
-	// Subscribe to the topic.
+	// Add the actual request, compressed if the client supports that.
 	//
-	subToken := p.mq.Subscribe("clients/"+host, 0, func(client MQTT.Client, msg MQTT.Message) {
+	req.Request, req.Encoding = encode(hello.Capabilities, requestDump)
 
-		//
-		// This function will be executed when a message is received
-		//
-		// To avoid loops we're making sure that the client publishes
-		// its response with a specific-prefix, so that it doesn't
-		// treat it as a request to be made.
-		//
-		// That means that we can identify it here too.
-		//
-		tmp := string(msg.Payload())
-		if strings.HasPrefix(tmp, "X-") {
-			response = tmp[2:]
-		}
-	})
-	subToken.Wait()
+	//
+	// This is the message we'll publish.
+	//
+	pub := &Publication{Topic: requestTopic(p.topicPrefix, host)}
 
 	//
-	// Did we get an error subscribing for the reply?
+	// Add the source-IP from which it was received.
 	//
-	if subToken.Error() != nil {
-		fmt.Printf("Error subscribing to clients/%s - %s\n", host, subToken.Error())
-		fmt.Fprintf(w, "Error subscribing to clients/%s - %s\n", host, subToken.Error())
-		return
+	// If both we and the client speak MQTT 5 we send this as a
+	// message-property, along with the topic and correlation-data
+	// for the reply, and an expiry time so that the broker will
+	// discard the request if it is not delivered before we give up.
+	//
+	if p.mq.MQTT5() && hasCapability(hello.Capabilities, capMQTT5) {
+		pub.Properties = map[string]string{"source": ip}
+		pub.ResponseTopic = responseTopic(p.topicPrefix, host, req.ID)
+		pub.Correlation = []byte(req.ID)
+		pub.Expiry = p.timeout
+	} else {
+		req.Source = ip
 	}
 
 	//
-	// We now busy-wait until we have a reply.
+	// Start the span covering the publication of the request, and
+	// pass its context to the client so that it may continue our
+	// trace.
 	//
-	// We wait for up to ten seconds before deciding the client
-	// is either a) offline, or b) failing.
+	pubCtx, pubSpan := tracer().Start(ctx, "tunneller.server.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", pub.Topic)))
+	req.Trace = make(map[string]string)
+	propagator().Inject(pubCtx, propagation.MapCarrier(req.Trace))
+
 	//
-	count := 0
-	for len(response) == 0 && count < 40 {
+	// Convert the structure to a JSON message, so we can send it down
+	// the queue.
+	//
+	pub.Payload, err = json.Marshal(req)
 
-		//
-		// Sleep .25 seconds; max count 40, result: 10 seconds.
-		//
-		fmt.Printf("Awaiting a reply ..\n")
-		time.Sleep(250 * time.Millisecond)
-		count++
+	if err != nil {
+		pubSpan.End()
+		settings.errorPage(w, http.StatusBadGateway, host, "The request could not be forwarded.")
+		p.log.Error("failed to encode the request as JSON", "tunnel", host, "error", err)
+		return
+	}
+
+	//
+	// Register our interest in the reply before we publish the
+	// request, so that we can't miss it.
+	//
+	reply := p.await(req.ID)
+	defer p.forget(req.ID)
+
+	//
+	// Publish the JSON object to the topic that we believe the client
+	// will be listening upon.
+	//
+	err = p.mq.Publish(pub)
+	if err != nil {
+		pubSpan.RecordError(err)
+		pubSpan.SetStatus(codes.Error, "failed to publish")
+	}
+	pubSpan.End()
+	if err != nil {
+		p.log.Error("failed to publish the request", "tunnel", host, "id", req.ID, "topic", pub.Topic, "error", err)
+		settings.errorPage(w, http.StatusServiceUnavailable, host, "The request could not be forwarded, please try again later.")
+		return
 	}
 
 	//
-	// Unsubscribe from the topic, regardless of whether we received
-	// a response or note.
+	// The (complete) response from the client will be placed here.
+	//
+	var response []byte
+
+	//
+	// We now wait until we have a reply.
 	//
-	// Just to cut down on resource-usage.
+	// We wait for up to ten seconds, by default, before deciding
+	// the client is either a) offline, or b) failing.
 	//
-	unsubToken := p.mq.Unsubscribe("clients/" + host)
-	unsubToken.Wait()
-	if unsubToken.Error() != nil {
-		fmt.Printf("Failed to unsubscribe from clients/%s - %s\n",
-			host, unsubToken.Error())
+	p.log.Debug("awaiting a reply", "tunnel", host, "id", req.ID)
+	select {
+	case res := <-reply:
+
+		//
+		// The client might have rejected our request.
+		//
+		if res.Error != "" {
+			settings.errorPage(w, http.StatusBadGateway, host,
+				fmt.Sprintf("The tunnel '%s' failed to process the request.", host))
+			p.log.Warn("the client failed to process the request", "tunnel", host, "id", req.ID, "error", res.Error)
+			return
+		}
+		response, err = decompress(res.Encoding, res.Response)
+		if err != nil {
+			settings.errorPage(w, http.StatusBadGateway, host,
+				fmt.Sprintf("The reply from the tunnel '%s' was invalid.", host))
+			p.log.Warn("failed to decompress the reply", "tunnel", host, "id", req.ID, "error", err)
+			return
+		}
+
+	case <-time.After(p.timeout):
 	}
 
 	//
@@ -242,19 +964,10 @@ func (p *serveCmd) HTTPHandler(w http.ResponseWriter, r *http.Request) {
 		//
 		// Failure-response.
 		//
-		// NOTE: This is a "complete" response.
-		//
-		response = `HTTP/1.0 503 OK
-Content-type: text/html; charset=UTF-8
-Connection: close
-
-<!DOCTYPE html>
-<html>
-<body>
-<p>We didn't receive a reply from the remote host, despite waiting 10 seconds.</p>
-</body>
-</html>
-`
+		p.metrics.timeouts.WithLabelValues(p.tunnelLabel(host)).Inc()
+		settings.errorPage(w, http.StatusServiceUnavailable, host,
+			fmt.Sprintf("We didn't receive a reply from the remote host, despite waiting %s.", p.timeout))
+		return
 	}
 
 	//
@@ -268,57 +981,293 @@ Connection: close
 	//   ..
 	//
 	// i.e. It will contain a full-response, headers, and body.
-	// So we need to use hijacking to return that to the caller.
 	//
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Webserver doesn't support hijacking", http.StatusInternalServerError)
-		fmt.Printf("Webserver doesn't support hijacking")
-		return
-	}
-	conn, bufrw, err := hj.Hijack()
+	// We parse that, and send it to the caller via our ResponseWriter,
+	// which allows keep-alive connections and HTTP/2 to be used.
+	//
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Printf("Error running hijack:%s", err.Error())
+		settings.errorPage(w, http.StatusBadGateway, host,
+			fmt.Sprintf("The reply from the tunnel '%s' was invalid.", host))
+		p.log.Warn("failed to parse the reply", "tunnel", host, "id", req.ID, "error", err)
 		return
 	}
+	defer res.Body.Close()
 
 	//
-	// Send the reply, and close the connection:
+	// We've already sent the request's ID, so we ignore any the
+	// service returned, rather than sending it twice.
 	//
-	fmt.Fprintf(bufrw, "%s", response)
-	bufrw.Flush()
-	conn.Close()
+	res.Header.Del(requestIDHeader)
+
+	//
+	// Record the relaying of the response to the visitor.
+	//
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	_, relaySpan := tracer().Start(ctx, "tunneller.server.relay")
+	writeResponse(w, res)
+	relaySpan.End()
+}
 
+//
+// hopHeaders are the "hop-by-hop" headers, which apply only to a single
+// connection, and must not be passed on by a proxy.
+//
+// See RFC 7230, section 6.1.
+//
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+//
+// removeHopHeaders removes the hop-by-hop headers from the given set,
+// including any which are named by the Connection header.
+//
+func removeHopHeaders(h http.Header) {
+	for _, field := range h["Connection"] {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+//
+// writeResponse sends the given response, received from a client, to the
+// visitor via the ResponseWriter.
+//
+// The hop-by-hop headers are removed, as the framing of the response is
+// handled by our own HTTP-server.
+//
+func writeResponse(w http.ResponseWriter, res *http.Response) {
+
+	removeHopHeaders(res.Header)
+
+	for name, values := range res.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	//
+	// Announce the trailers we'll send after the body.
+	//
+	for name := range res.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+
+	for name, values := range res.Trailer {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
 }
 
 // Execute is the entry-point to this sub-command.
 func (p *serveCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 
+	//
+	// Read our environment variables, and our configuration file,
+	// for anything not set upon the command-line.
+	//
+	set := flagsSet(f)
+	if err := applyEnv(f, set); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return 1
+	}
+	cfg, err := p.loadConfig()
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return 1
+	}
+	if err = applyValues(f, set, cfg.flagValues()); err != nil {
+		fmt.Printf("%s: %s\n", p.config, err.Error())
+		return 1
+	}
+	settings, err := newServerSettings(cfg)
+	if err != nil {
+		fmt.Printf("%s: %s\n", p.config, err.Error())
+		return 1
+	}
+	p.settings.Store(settings)
+
+	if p.proxyProtocol && len(settings.trusted) == 0 {
+		fmt.Printf("-proxy-protocol requires the trusted-proxies to be listed in the -config file\n")
+		return 1
+	}
+
+	//
+	// Setup our logger.
+	//
+	var closeLog func()
+	p.log, closeLog, err = p.logOpts.newLogger(os.Stdout)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return 1
+	}
+	defer closeLog()
+
+	//
+	// Setup our tracing.
+	//
+	stopTracing, err := setupTracing(p.otlpEndpoint, "tunneller-server", p.log)
+	if err != nil {
+		fmt.Printf("Failed to setup tracing: %s\n", err.Error())
+		return 1
+	}
+	defer stopTracing()
+
+	if p.accessLogPath != "" {
+		p.accessLog, err = openAccessLog(p.accessLogPath, p.accessLogFormat, p.accessLogMaxSize*1024*1024, p.accessLogBackups)
+		if err != nil {
+			fmt.Printf("Failed to open the access log: %s\n", err.Error())
+			return 1
+		}
+		defer p.accessLog.Close()
+	}
+
+	//
+	// Reload our configuration when we receive SIGHUP, and reopen
+	// our access log so that it may be rotated.
+	//
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if reopenErr := p.accessLog.Reopen(); reopenErr != nil {
+				p.log.Error("failed to reopen the access log", "file", p.accessLogPath, "error", reopenErr)
+			}
+			if reloadErr := p.reload(); reloadErr != nil {
+				p.log.Error("failed to reload the configuration", "file", p.config, "error", reloadErr)
+				continue
+			}
+			p.log.Info("reloaded the configuration", "file", p.config)
+		}
+	}()
+
 	//
 	// Connect to our MQ instance.
 	//
-	mq := fmt.Sprintf("tcp://localhost:%d", p.mqPort)
-	fmt.Printf("Connecting to MQ %s\n", mq)
+	if err = validTopicPrefix(p.topicPrefix); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return 1
+	}
+	p.pending = make(map[string]chan Response)
+	p.clients = make(map[string]Hello)
+	p.announced = make(map[string][]string)
+	p.owners = make(map[string]string)
+	p.access = make(map[string]accessList)
+	p.rejected = make(map[string]map[string]int)
+	p.metrics = newServerMetrics(p)
 
-	opts := MQTT.NewClientOptions().AddBroker(mq)
-	p.mq = MQTT.NewClient(opts)
-	if token := p.mq.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Printf("Failed to connect to MQ-server: %s\n", token.Error())
+	mq := fmt.Sprintf("localhost:%d", p.mqPort)
+	p.log.Info("connecting to MQ", "broker", mq)
+
+	var extra []string
+	if p.mqtt5 {
+		extra = append(extra, capMQTT5)
+	}
+	hello, err := json.Marshal(newHello(stateOnline, extra...))
+	if err != nil {
+		fmt.Printf("Failed to encode our hello: %s\n", err.Error())
+		return 1
+	}
+	stopping, err := json.Marshal(newHello(stateStopping, extra...))
+	if err != nil {
+		fmt.Printf("Failed to encode our hello: %s\n", err.Error())
+		return 1
+	}
+	goodbye, err := json.Marshal(newHello(stateOffline, extra...))
+	if err != nil {
+		fmt.Printf("Failed to encode our hello: %s\n", err.Error())
 		return 1
 	}
 
 	//
-	// We present a HTTP-server, and we handle all incoming
-	// requests (both in terms of path and method).
+	// If we go away unexpectedly the clients are told that we've
+	// gone offline.
 	//
-	http.HandleFunc("/", p.HTTPHandler)
+	opts := BusOptions{
+		Broker:   mq,
+		MQTT5:    p.mqtt5,
+		Username: p.mqUsername,
+		Password: p.mqPassword,
+		Will: &Publication{
+			Topic:   helloTopic(p.topicPrefix, serverName),
+			Payload: goodbye,
+			Retain:  true,
+		},
+	}
 
 	//
-	// Show where we'll bind
+	// Once we're connected we announce ourselves, and subscribe to
+	// the announcements and replies from all clients.
 	//
-	bind := fmt.Sprintf("%s:%d", p.bindHost, p.bindPort)
-	fmt.Printf("Launching the server on http://%s\n", bind)
+	// This is repeated upon every reconnection.
+	//
+	connects := 0
+	opts.OnConnect = func(bus Bus) {
+
+		connects++
+		if connects > 1 {
+			p.metrics.reconnects.Inc()
+		}
+		p.connected.Store(true)
+
+		topic := helloTopic(p.topicPrefix, serverName)
+		if pubErr := bus.Publish(&Publication{Topic: topic, Payload: hello, Retain: true}); pubErr != nil {
+			p.log.Error("failed to announce ourselves", "topic", topic, "error", pubErr)
+		}
+
+		subs := map[string]MessageHandler{
+			helloWildcard(p.topicPrefix):    p.onHello,
+			responseWildcard(p.topicPrefix): p.onResponse,
+		}
+		subscribed := true
+		for filter, handler := range subs {
+			if subErr := bus.Subscribe(filter, handler); subErr != nil {
+				p.log.Error("failed to subscribe", "topic", filter, "error", subErr)
+				subscribed = false
+			}
+		}
+		p.subscribed.Store(subscribed)
+	}
+
+	//
+	// Our subscriptions are lost along with our connection, and
+	// restored when we reconnect.
+	//
+	opts.OnConnectionLost = func(lostErr error) {
+		p.connected.Store(false)
+		p.subscribed.Store(false)
+		p.log.Warn("lost our connection to MQ", "error", lostErr)
+	}
+	p.mq, err = NewBus(opts)
+	if err != nil {
+		p.log.Error("failed to connect to MQ", "broker", mq, "error", err)
+		return 1
+	}
+
+	//
+	// We present a HTTP-server, and we handle all incoming
+	// requests (both in terms of path and method).
+	//
+	http.Handle("/", p.instrument(http.HandlerFunc(p.HTTPHandler)))
 
 	//
 	// We want to make sure we handle timeouts effectively by using
@@ -328,23 +1277,129 @@ func (p *serveCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 	// proxy to the client will timeout after 10 seconds..
 	//
 	srv := &http.Server{
-		Addr:         bind,
 		ReadTimeout:  300 * time.Second,
 		WriteTimeout: 300 * time.Second,
 	}
 
 	//
-	// Launch the server.
+	// As well as HTTP/1.x we accept unencrypted HTTP/2, so that a
+	// TLS-terminating proxy in front of us may use HTTP/2 throughout.
 	//
-	err := srv.ListenAndServe()
-	if err != nil {
-		fmt.Printf("\nError launching our HTTP-server\n:%s\n",
-			err.Error())
-		return 1
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	//
+	// Launch the server, until we're told to stop.
+	//
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go p.reportRejections(ctx, time.Second)
+
+	//
+	// We listen upon each of the addresses we're given, so that we
+	// may serve both IPv4 and IPv6 visitors.
+	//
+	// An IPv6 address is bound to only accept IPv6 connections, so
+	// that "0.0.0.0,::" may be given without the two clashing.
+	//
+	hosts := strings.Split(p.bindHost, ",")
+	failed := make(chan error, len(hosts)+1)
+	for _, host := range hosts {
+		network, bind := listenAddress(host, p.bindPort)
+		p.log.Info("launching the server", "address", "http://"+bind)
+
+		go func() {
+			listener, listenErr := net.Listen(network, bind)
+			if listenErr != nil {
+				failed <- listenErr
+				return
+			}
+			if p.proxyProtocol {
+				listener = &proxyproto.Listener{Listener: listener, ConnPolicy: p.proxyPolicy}
+			}
+			failed <- srv.Serve(listener)
+		}()
 	}
 
 	//
-	// Not reached.
+	// Launch our admin listener, if we have one.
 	//
-	return 0
+	var admin *http.Server
+	if p.admin != "" {
+		p.log.Info("launching the admin server", "address", "http://"+p.admin)
+		admin = &http.Server{
+			Addr:         p.admin,
+			Handler:      p.adminHandler(),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			failed <- admin.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err = <-failed:
+		p.log.Error("failed to launch our HTTP-server", "error", err)
+		srv.Close()
+		if admin != nil {
+			admin.Close()
+		}
+		p.mq.Disconnect()
+		return 1
+	case <-ctx.Done():
+
+		//
+		// A second signal will terminate us immediately.
+		//
+		stop()
+	}
+
+	return p.shutdown(srv, admin, stopping, goodbye)
 }
+
+//
+// shutdown stops our server gracefully.
+//
+// We stop accepting new connections, and tell our clients that we're
+// stopping, then wait for the requests which are in-flight to complete.
+// Once they have, or our deadline passes, we tell the clients that we've
+// gone offline and disconnect from MQ.
+//
+// Our admin listener, if any, remains available until we're done, and
+// reports that we're not ready.
+//
+func (p *serveCmd) shutdown(srv *http.Server, admin *http.Server, stopping []byte, goodbye []byte) subcommands.ExitStatus {
+
+	p.log.Info("shutting down, waiting for in-flight requests", "timeout", p.drainTimeout)
+	p.stopping.Store(true)
+
+	topic := helloTopic(p.topicPrefix, serverName)
+	if err := p.mq.Publish(&Publication{Topic: topic, Payload: stopping, Retain: true}); err != nil {
+		p.log.Error("failed to announce that we're stopping", "topic", topic, "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.drainTimeout)
+	defer cancel()
+
+	status := subcommands.ExitSuccess
+	if err := srv.Shutdown(ctx); err != nil {
+		p.log.Error("failed to complete the in-flight requests", "error", err)
+		status = subcommands.ExitFailure
+	}
+
+	if err := p.mq.Publish(&Publication{Topic: topic, Payload: goodbye, Retain: true}); err != nil {
+		p.log.Error("failed to announce that we've gone offline", "topic", topic, "error", err)
+	}
+	p.mq.Disconnect()
+
+	if admin != nil {
+		admin.Close()
+	}
+
+	p.log.Info("shutdown complete")
+	return status
+}
+
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mustNetworks parses the given networks, failing the test on error.
+func mustNetworks(t *testing.T, list ...string) []*net.IPNet {
+	t.Helper()
+	out, err := parseNetworks(list)
+	if err != nil {
+		t.Fatalf("failed to parse %v: %s", list, err)
+	}
+	return out
+}
+
+// TestParseAddress tests the addresses we extract from peers and headers.
+func TestParseAddress(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{" 1.2.3.4 ", "1.2.3.4"},
+		{"1.2.3.4:8080", "1.2.3.4"},
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"[::1]:8080", "::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"[::ffff:1.2.3.4]:80", "1.2.3.4"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:80", "fe80::1"},
+		{"", ""},
+		{"unknown", ""},
+		{"example.com:80", ""},
+		{"1.2.3.4.5", ""},
+	}
+
+	for _, tst := range tests {
+		out := parseAddress(tst.input)
+		if out != tst.output {
+			t.Errorf("parseAddress(%q) gave %q, expected %q", tst.input, out, tst.output)
+		}
+	}
+}
+
+// TestRemoteIP tests that we only believe X-Forwarded-For when it was
+// sent by proxies we trust.
+func TestRemoteIP(t *testing.T) {
+
+	trusted := mustNetworks(t, "10.0.0.0/8", "::1")
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		trusted   []*net.IPNet
+		output    string
+	}{
+		{"direct", "1.2.3.4:1234", nil, trusted, "1.2.3.4"},
+		{"direct-ipv6", "[2001:db8::1]:1234", nil, trusted, "2001:db8::1"},
+		{"untrusted-peer", "1.2.3.4:1234", []string{"5.6.7.8"}, trusted, "1.2.3.4"},
+		{"no-trusted-proxies", "10.0.0.1:1234", []string{"5.6.7.8"}, nil, "10.0.0.1"},
+		{"trusted-peer", "10.0.0.1:1234", []string{"5.6.7.8"}, trusted, "5.6.7.8"},
+		{"trusted-ipv6-peer", "[::1]:1234", []string{"5.6.7.8"}, trusted, "5.6.7.8"},
+		{"trusted-peer-no-header", "10.0.0.1:1234", nil, trusted, "10.0.0.1"},
+		{"trusted-chain", "10.0.0.1:1234", []string{"5.6.7.8, 10.0.0.2, 10.0.0.3"}, trusted, "5.6.7.8"},
+		{"spoofed-chain", "10.0.0.1:1234", []string{"9.9.9.9, 5.6.7.8, 10.0.0.2"}, trusted, "5.6.7.8"},
+		{"multiple-headers", "10.0.0.1:1234", []string{"9.9.9.9", "5.6.7.8"}, trusted, "5.6.7.8"},
+		{"all-trusted", "10.0.0.1:1234", []string{"10.0.0.2, 10.0.0.3"}, trusted, "10.0.0.2"},
+		{"garbage-skipped", "10.0.0.1:1234", []string{"5.6.7.8, unknown"}, trusted, "5.6.7.8"},
+		{"port-and-brackets", "10.0.0.1:1234", []string{"[2001:db8::2]:443"}, trusted, "2001:db8::2"},
+		{"mapped", "10.0.0.1:1234", []string{"::ffff:5.6.7.8"}, trusted, "5.6.7.8"},
+	}
+
+	for _, tst := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tst.peer
+		for _, value := range tst.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+
+		out := RemoteIP(req, tst.trusted)
+		if out != tst.output {
+			t.Errorf("%s: RemoteIP gave %q, expected %q", tst.name, out, tst.output)
+		}
+	}
+}
+
+// TestDumpRequest tests that the requests we send to our clients can be
+// parsed, with their bodies intact, however the visitor sent them.
+func TestDumpRequest(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		proto    int
+		length   int64
+		chunked  bool
+		body     string
+		expected string
+	}{
+		{"http1-empty", 1, 0, false, "", ""},
+		{"http1-length", 1, 5, false, "hello", "hello"},
+		{"http1-chunked", 1, -1, true, "hello", "hello"},
+		{"http2-empty", 2, 0, false, "", ""},
+		{"http2-length", 2, 5, false, "hello", "hello"},
+		{"http2-no-length", 2, -1, false, "hello, world", "hello, world"},
+	}
+
+	for _, tst := range tests {
+		req := httptest.NewRequest("POST", "http://example.com/path", strings.NewReader(tst.body))
+		req.ContentLength = tst.length
+		req.Header.Del("Content-Length")
+		if tst.length > 0 && tst.proto == 1 {
+			req.Header.Set("Content-Length", strconv.FormatInt(tst.length, 10))
+		}
+		if tst.chunked {
+			req.TransferEncoding = []string{"chunked"}
+		}
+		if tst.proto == 2 {
+			req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+		}
+
+		dump, err := dumpRequest(req)
+		if err != nil {
+			t.Errorf("%s: failed to dump the request: %s", tst.name, err)
+			continue
+		}
+		if req.ProtoMajor != tst.proto {
+			t.Errorf("%s: the original request was modified", tst.name)
+		}
+
+		out, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(dump)))
+		if err != nil {
+			t.Errorf("%s: failed to parse the dumped request: %s", tst.name, err)
+			continue
+		}
+		body, err := io.ReadAll(out.Body)
+		if err != nil {
+			t.Errorf("%s: failed to read the body: %s", tst.name, err)
+			continue
+		}
+		if string(body) != tst.expected {
+			t.Errorf("%s: the body was %q, expected %q", tst.name, body, tst.expected)
+		}
+		if out.Host != "example.com" || out.URL.Path != "/path" {
+			t.Errorf("%s: the request was for %s%s", tst.name, out.Host, out.URL.Path)
+		}
+	}
+}
+
+// TestListenAddress tests the addresses we listen upon for -host.
+func TestListenAddress(t *testing.T) {
+
+	tests := []struct {
+		host    string
+		network string
+		address string
+	}{
+		{"127.0.0.1", "tcp4", "127.0.0.1:8080"},
+		{" 0.0.0.0 ", "tcp4", "0.0.0.0:8080"},
+		{"::", "tcp6", "[::]:8080"},
+		{"::1", "tcp6", "[::1]:8080"},
+		{"[::1]", "tcp6", "[::1]:8080"},
+		{"[2001:db8::1]", "tcp6", "[2001:db8::1]:8080"},
+		{"::ffff:127.0.0.1", "tcp4", "127.0.0.1:8080"},
+		{"localhost", "tcp", "localhost:8080"},
+		{"", "tcp", ":8080"},
+	}
+
+	for _, tst := range tests {
+		network, address := listenAddress(tst.host, 8080)
+		if network != tst.network || address != tst.address {
+			t.Errorf("listenAddress(%q) gave %s %s, expected %s %s", tst.host, network, address, tst.network, tst.address)
+		}
+	}
+}
+
+// TestRemoveHopHeaders tests the removal of hop-by-hop headers.
+func TestRemoveHopHeaders(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		kept    []string
+		removed []string
+	}{
+		{
+			name: "standard",
+			headers: map[string]string{
+				"Connection":        "keep-alive",
+				"Keep-Alive":        "timeout=5",
+				"Transfer-Encoding": "chunked",
+				"Upgrade":           "h2c",
+				"Trailer":           "X-Checksum",
+				"Content-Type":      "text/plain",
+			},
+			kept:    []string{"Content-Type"},
+			removed: []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Trailer"},
+		},
+		{
+			name: "named-by-connection",
+			headers: map[string]string{
+				"Connection":   "close, X-Private , X-Other",
+				"X-Private":    "secret",
+				"X-Other":      "secret",
+				"X-Public":     "value",
+				"Content-Type": "text/plain",
+			},
+			kept:    []string{"X-Public", "Content-Type"},
+			removed: []string{"Connection", "X-Private", "X-Other"},
+		},
+	}
+
+	for _, tst := range tests {
+		h := make(http.Header)
+		for name, value := range tst.headers {
+			h.Set(name, value)
+		}
+
+		removeHopHeaders(h)
+
+		for _, name := range tst.kept {
+			if h.Get(name) == "" {
+				t.Errorf("%s: %s was removed", tst.name, name)
+			}
+		}
+		for _, name := range tst.removed {
+			if _, found := h[http.CanonicalHeaderKey(name)]; found {
+				t.Errorf("%s: %s wasn't removed", tst.name, name)
+			}
+		}
+	}
+}
+
+// TestWriteResponse tests relaying the responses our clients send to the
+// visitor, via a ResponseWriter.
+func TestWriteResponse(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		response string
+		status   int
+		body     string
+		headers  map[string]string
+		trailers map[string]string
+		cookies  int
+	}{
+		{
+			name:     "simple",
+			response: "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello",
+			status:   http.StatusOK,
+			body:     "hello",
+			headers:  map[string]string{"Content-Type": "text/plain", "Content-Length": "5"},
+		},
+		{
+			name:     "not-found",
+			response: "HTTP/1.1 404 Not Found\r\nContent-Length: 4\r\n\r\nnope",
+			status:   http.StatusNotFound,
+			body:     "nope",
+		},
+		{
+			name:     "hop-headers",
+			response: "HTTP/1.1 200 OK\r\nConnection: keep-alive, X-Private\r\nX-Private: secret\r\nKeep-Alive: timeout=5\r\nContent-Length: 2\r\n\r\nok",
+			status:   http.StatusOK,
+			body:     "ok",
+			headers:  map[string]string{"Connection": "", "X-Private": "", "Keep-Alive": ""},
+		},
+		{
+			name:     "chunked-with-trailers",
+			response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abcd\r\n\r\n",
+			status:   http.StatusOK,
+			body:     "hello world",
+			headers:  map[string]string{"Transfer-Encoding": ""},
+			trailers: map[string]string{"X-Checksum": "abcd"},
+		},
+		{
+			name:     "multiple-values",
+			response: "HTTP/1.1 200 OK\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\nContent-Length: 0\r\n\r\n",
+			status:   http.StatusOK,
+			cookies:  2,
+		},
+	}
+
+	for _, tst := range tests {
+		res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(tst.response)), nil)
+		if err != nil {
+			t.Fatalf("%s: failed to parse the response: %s", tst.name, err)
+		}
+
+		rec := httptest.NewRecorder()
+		writeResponse(rec, res)
+		out := rec.Result()
+
+		body, _ := io.ReadAll(out.Body)
+		if out.StatusCode != tst.status {
+			t.Errorf("%s: the status was %d, expected %d", tst.name, out.StatusCode, tst.status)
+		}
+		if string(body) != tst.body {
+			t.Errorf("%s: the body was %q, expected %q", tst.name, body, tst.body)
+		}
+		for name, value := range tst.headers {
+			if got := out.Header.Get(name); got != value {
+				t.Errorf("%s: %s was %q, expected %q", tst.name, name, got, value)
+			}
+		}
+		for name, value := range tst.trailers {
+			if got := out.Trailer.Get(name); got != value {
+				t.Errorf("%s: the trailer %s was %q, expected %q", tst.name, name, got, value)
+			}
+		}
+		if cookies := out.Header.Values("Set-Cookie"); len(cookies) != tst.cookies {
+			t.Errorf("%s: the cookies were %v, expected %d", tst.name, cookies, tst.cookies)
+		}
+	}
+}
+
+// TestValidRequestID tests the request IDs we accept from visitors.
+func TestValidRequestID(t *testing.T) {
+
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"", false},
+		{"abc123", true},
+		{"0b5e4c1a-7f2d-4e3b-9a6c-1d2e3f4a5b6c", true},
+		{"req:1/2;x=y!~", true},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+		{"two words", false},
+		{"tab\there", false},
+		{"line\nbreak", false},
+		{"del\x7f", false},
+		{"café", false},
+	}
+
+	for _, tst := range tests {
+		if out := validRequestID(tst.id); out != tst.valid {
+			t.Errorf("validRequestID(%q) gave %v, expected %v", tst.id, out, tst.valid)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"runtime"
+	"strings"
 
 	"github.com/google/subcommands"
 )
@@ -44,8 +45,12 @@ func (p *versionCmd) SetFlags(f *flag.FlagSet) {
 //
 func showVersion(verbose bool) {
 	fmt.Printf("%s\n", version)
+	fmt.Printf("Protocol version %d\n", ProtocolVersion)
 	if verbose {
 		fmt.Printf("Built with %s\n", runtime.Version())
+		if len(capabilities) > 0 {
+			fmt.Printf("Capabilities %s\n", strings.Join(capabilities, ", "))
+		}
 	}
 }
 
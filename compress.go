@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compression of the HTTP-traffic we send upon the message-bus.
+//
+// The algorithms we support are announced as capabilities in our Hello
+// message, and the sender of a message picks the first of its preferred
+// algorithms which the recipient also supports.  The algorithm used, if
+// any, is recorded in the Encoding field of the Request or Response.
+//
+
+// The names of the compression algorithms we support.
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+)
+
+// encodings holds the compression algorithms we support, in order of
+// preference.
+var encodings = []string{encodingZstd, encodingGzip}
+
+// minCompressSize is the size below which we don't bother to compress
+// messages, as the saving would be negligible.
+const minCompressSize = 1024
+
+// maxDecompressSize is the largest message we'll decompress, to avoid
+// being overwhelmed by a malicious "compression bomb".
+const maxDecompressSize = 256 * 1024 * 1024
+
+// incompressible holds the prefixes of the content-types which are
+// already compressed, and so will not benefit from further compression.
+var incompressible = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-bzip2",
+	"application/x-gzip",
+	"application/x-xz",
+}
+
+var (
+	// zstdEncoder and zstdDecoder are created upon first use, and
+	// are safe for concurrent use.
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdOnce    sync.Once
+	zstdErr     error
+)
+
+// setupZstd creates our zstd encoder and decoder.
+func setupZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressSize))
+	})
+	return zstdErr
+}
+
+// negotiateEncoding returns the compression algorithm to use when sending
+// to a peer with the given capabilities, or "" if there is none in common.
+func negotiateEncoding(peer []string) string {
+	for _, enc := range encodings {
+		if hasCapability(peer, enc) {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressible returns true if the given HTTP-message would benefit
+// from compression.
+//
+// Small messages are ignored, as are those which have a Content-Encoding
+// or a Content-Type which shows they're already compressed.
+func compressible(msg []byte) bool {
+
+	if len(msg) < minCompressSize {
+		return false
+	}
+
+	//
+	// Skip the request/status line, then parse the headers.
+	//
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg)))
+	if _, err := reader.ReadLine(); err != nil {
+		return false
+	}
+	headers, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return true
+	}
+
+	if enc := headers.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+
+	ctype := strings.ToLower(headers.Get("Content-Type"))
+	for _, prefix := range incompressible {
+		if strings.HasPrefix(ctype, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compress compresses the given message with the named algorithm.
+func compress(encoding string, msg []byte) ([]byte, error) {
+
+	switch encoding {
+	case "":
+		return msg, nil
+
+	case encodingGzip:
+		var out bytes.Buffer
+		w := gzip.NewWriter(&out)
+		if _, err := w.Write(msg); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+
+	case encodingZstd:
+		if err := setupZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(msg, nil), nil
+	}
+
+	return nil, fmt.Errorf("unknown encoding '%s'", encoding)
+}
+
+// decompress decompresses the given message, which was compressed with
+// the named algorithm.
+func decompress(encoding string, msg []byte) ([]byte, error) {
+
+	switch encoding {
+	case "":
+		return msg, nil
+
+	case encodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(msg))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		out, err := io.ReadAll(io.LimitReader(r, maxDecompressSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxDecompressSize {
+			return nil, fmt.Errorf("decompressed message exceeds %d bytes", maxDecompressSize)
+		}
+		return out, nil
+
+	case encodingZstd:
+		if err := setupZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(msg, nil)
+	}
+
+	return nil, fmt.Errorf("unknown encoding '%s'", encoding)
+}
+
+// encode compresses the given message for a peer with the given
+// capabilities, if that is worthwhile, returning the message and the
+// name of the algorithm used.
+//
+// If compression fails the message is returned unchanged.
+func encode(peer []string, msg []byte) ([]byte, string) {
+
+	encoding := negotiateEncoding(peer)
+	if encoding == "" || !compressible(msg) {
+		return msg, ""
+	}
+
+	out, err := compress(encoding, msg)
+	if err != nil || len(out) >= len(msg) {
+		return msg, ""
+	}
+	return out, encoding
+}
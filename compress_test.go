@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testMessage returns an HTTP-response with the given content-type and
+// a body of the given size.
+func testMessage(ctype string, size int) []byte {
+	body := strings.Repeat("tunneller ", size/10+1)[:size]
+	return []byte("HTTP/1.1 200 OK\r\nContent-Type: " + ctype + "\r\n\r\n" + body)
+}
+
+// TestCompressRoundTrip tests that messages survive compression, and
+// decompression, intact.
+func TestCompressRoundTrip(t *testing.T) {
+
+	binary := make([]byte, 4096)
+	for i := range binary {
+		binary[i] = byte(i * 7)
+	}
+
+	messages := [][]byte{
+		nil,
+		[]byte("short"),
+		testMessage("text/html", 4096),
+		binary,
+	}
+
+	for _, encoding := range []string{"", encodingGzip, encodingZstd} {
+		for _, msg := range messages {
+			compressed, err := compress(encoding, msg)
+			if err != nil {
+				t.Errorf("%q: failed to compress: %s", encoding, err)
+				continue
+			}
+			out, err := decompress(encoding, compressed)
+			if err != nil {
+				t.Errorf("%q: failed to decompress: %s", encoding, err)
+				continue
+			}
+			if !bytes.Equal(out, msg) {
+				t.Errorf("%q: the message was mangled", encoding)
+			}
+		}
+	}
+}
+
+// TestUnknownEncoding tests that we refuse encodings we don't support.
+func TestUnknownEncoding(t *testing.T) {
+
+	if _, err := compress("brotli", []byte("test")); err == nil {
+		t.Errorf("compressed with an unknown encoding")
+	}
+	if _, err := decompress("brotli", []byte("test")); err == nil {
+		t.Errorf("decompressed with an unknown encoding")
+	}
+	for _, encoding := range []string{encodingGzip, encodingZstd} {
+		if _, err := decompress(encoding, []byte("not compressed")); err == nil {
+			t.Errorf("%s: decompressed garbage", encoding)
+		}
+	}
+}
+
+// TestNegotiateEncoding tests choosing the compression to use for a peer.
+func TestNegotiateEncoding(t *testing.T) {
+
+	tests := []struct {
+		peer     []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"brotli"}, ""},
+		{[]string{encodingGzip}, encodingGzip},
+		{[]string{encodingZstd}, encodingZstd},
+		{[]string{encodingGzip, encodingZstd}, encodingZstd},
+	}
+
+	for _, tst := range tests {
+		if out := negotiateEncoding(tst.peer); out != tst.expected {
+			t.Errorf("negotiateEncoding(%v) gave %q, expected %q", tst.peer, out, tst.expected)
+		}
+	}
+}
+
+// TestEncode tests which messages we compress.
+func TestEncode(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		peer     []string
+		msg      []byte
+		expected string
+	}{
+		{"text", encodings, testMessage("text/html", 4096), encodingZstd},
+		{"gzip-peer", []string{encodingGzip}, testMessage("text/html", 4096), encodingGzip},
+		{"old-peer", nil, testMessage("text/html", 4096), ""},
+		{"small", encodings, testMessage("text/html", 100), ""},
+		{"image", encodings, testMessage("image/png", 4096), ""},
+		{"archive", encodings, testMessage("application/zip", 4096), ""},
+		{"encoded", encodings, []byte("HTTP/1.1 200 OK\r\nContent-Encoding: br\r\n\r\n" + strings.Repeat("x", 4096)), ""},
+		{"identity", encodings, []byte("HTTP/1.1 200 OK\r\nContent-Encoding: identity\r\n\r\n" + strings.Repeat("x", 4096)), encodingZstd},
+	}
+
+	for _, tst := range tests {
+		out, encoding := encode(tst.peer, tst.msg)
+		if encoding != tst.expected {
+			t.Errorf("%s: encoded with %q, expected %q", tst.name, encoding, tst.expected)
+			continue
+		}
+		if encoding == "" && !bytes.Equal(out, tst.msg) {
+			t.Errorf("%s: the uncompressed message was changed", tst.name)
+		}
+		plain, err := decompress(encoding, out)
+		if err != nil || !bytes.Equal(plain, tst.msg) {
+			t.Errorf("%s: the message didn't survive decompression: %v", tst.name, err)
+		}
+	}
+}
+
+// TestDecompressLimit tests that we refuse to decompress messages which
+// would exceed our limit.
+func TestDecompressLimit(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("skipping the decompression of large messages")
+	}
+
+	//
+	// Compress a message a little larger than our limit, which
+	// consists of zeros so that it compresses well.
+	//
+	chunk := make([]byte, 1024*1024)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+
+	var zs bytes.Buffer
+	zw, err := zstd.NewWriter(&zs)
+	if err != nil {
+		t.Fatalf("failed to create the zstd writer: %s", err)
+	}
+
+	for written := 0; written <= maxDecompressSize; written += len(chunk) {
+		gw.Write(chunk)
+		zw.Write(chunk)
+	}
+	gw.Close()
+	zw.Close()
+
+	tests := []struct {
+		encoding string
+		msg      []byte
+	}{
+		{encodingGzip, gz.Bytes()},
+		{encodingZstd, zs.Bytes()},
+	}
+
+	for _, tst := range tests {
+		if _, err = decompress(tst.encoding, tst.msg); err == nil {
+			t.Errorf("%s: decompressed a message larger than %d bytes", tst.encoding, maxDecompressSize)
+		}
+	}
+}
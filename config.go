@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Our configuration.
+//
+// Everything may be configured via command-line flags, but the client
+// may also read a configuration file defining the servers it connects
+// to, and the tunnels it exposes, for example:
+//
+//	servers:
+//	  work:
+//	    tunnel: tunnel.example.com
+//	    username: steve
+//	    password: secret
+//	tunnels:
+//	  api:
+//	    expose: localhost:8080
+//	  web:
+//	    expose: https://localhost:8443
+//	    upstream-insecure: true
+//	    forwarded-headers: x-forwarded
+//	    allow: [/etc/tunneller/github-hooks.txt]
+//	profiles:
+//	  work:
+//	    server: work
+//	    tunnels: [api, web]
+//	default: work
+//
+// Values are taken from the command-line first, then from environment
+// variables, and finally from the configuration file.  Each flag may be
+// set via an environment variable named after it, so "-mq-port" may be
+// set via $TUNNELLER_MQ_PORT.
+//
+
+// envPrefix is the prefix of the environment variables which may be used
+// in place of our command-line flags.
+const envPrefix = "TUNNELLER_"
+
+// clientConfig is the configuration file read by the client.
+type clientConfig struct {
+	// Servers holds the servers we may connect to, keyed by name.
+	Servers map[string]serverProfile `yaml:"servers"`
+
+	// Tunnels holds the tunnels we may expose, keyed by name.
+	Tunnels map[string]tunnelConfig `yaml:"tunnels"`
+
+	// Profiles holds the named combinations of a server, and the
+	// tunnels to expose via it.
+	Profiles map[string]clientProfile `yaml:"profiles"`
+
+	// Default is the name of the profile to use if none is given.
+	Default string `yaml:"default"`
+}
+
+// serverProfile describes a server we may connect to.
+type serverProfile struct {
+	Tunnel       string        `yaml:"tunnel"`
+	MQPort       int           `yaml:"mq-port"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	TopicPrefix  string        `yaml:"topic-prefix"`
+	MQTT5        bool          `yaml:"mqtt5"`
+	ReconnectMax time.Duration `yaml:"reconnect-max"`
+}
+
+// tunnelConfig describes a tunnel we may expose.
+//
+// The upstream options default to those given on the command-line.
+type tunnelConfig struct {
+	Expose   string        `yaml:"expose"`
+	Timeout  time.Duration `yaml:"upstream-timeout"`
+	Insecure bool          `yaml:"upstream-insecure"`
+	CA       string        `yaml:"upstream-ca"`
+	SNI      string        `yaml:"upstream-sni"`
+	Cert     string        `yaml:"upstream-cert"`
+	Key      string        `yaml:"upstream-key"`
+
+	// Forwarded is the set of forwarding headers the server adds
+	// to our requests.
+	Forwarded string `yaml:"forwarded-headers"`
+
+	// Allow and Deny hold the networks visitors may, and may not,
+	// make requests from, or the files containing them.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	// Auth holds the users who may make requests, as "user:password",
+	// and Htpasswd the path to a file containing more of them.
+	Auth     []string `yaml:"auth"`
+	Htpasswd string   `yaml:"htpasswd"`
+}
+
+// namedTunnel is a tunnel, from the configuration file, which has been
+// selected to be exposed.
+type namedTunnel struct {
+	name   string
+	config tunnelConfig
+}
+
+// clientProfile is a named combination of a server, and the tunnels to
+// expose via it.
+type clientProfile struct {
+	Server  string   `yaml:"server"`
+	Tunnels []string `yaml:"tunnels"`
+}
+
+// defaultConfigPath returns the path to the configuration file which is
+// read if none is specified, ~/.config/tunneller/config.yaml on Unix.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "tunneller", "config.yaml")
+}
+
+// loadConfig reads the configuration file at the given path into the
+// given structure.
+//
+// If the file doesn't exist, and it is optional, then that isn't an
+// error.
+func loadConfig(path string, optional bool, out interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if optional && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(out)
+
+	//
+	// A file which is empty, or only contains comments, is an empty
+	// configuration rather than a broken one.
+	//
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// flagsSet returns the names of the flags which were given upon the
+// command-line.
+func flagsSet(f *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	f.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+	return set
+}
+
+// envName returns the name of the environment variable which may be used
+// in place of the named flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets each flag which wasn't given upon the command-line from
+// its environment variable, if that is set.
+//
+// The flags which are set are added to the given map.
+func applyEnv(f *flag.FlagSet, set map[string]bool) error {
+	var err error
+	f.VisitAll(func(fl *flag.Flag) {
+		if err != nil || set[fl.Name] {
+			return
+		}
+		if val, ok := os.LookupEnv(envName(fl.Name)); ok {
+			if setErr := f.Set(fl.Name, val); setErr != nil {
+				err = fmt.Errorf("invalid value for $%s: %s", envName(fl.Name), setErr.Error())
+				return
+			}
+			set[fl.Name] = true
+		}
+	})
+	return err
+}
+
+// applyValues sets each of the given flags which isn't already set, from
+// the given map of values.
+//
+// The flags which are set are added to the given map.
+func applyValues(f *flag.FlagSet, set map[string]bool, values map[string]string) error {
+	for name, val := range values {
+		if set[name] {
+			continue
+		}
+		if err := f.Set(name, val); err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err.Error())
+		}
+		set[name] = true
+	}
+	return nil
+}
+
+// flagValues returns the values from the server-profile which are set,
+// keyed by the name of the flag they correspond to.
+func (s serverProfile) flagValues() map[string]string {
+	values := make(map[string]string)
+	if s.Tunnel != "" {
+		values["tunnel"] = s.Tunnel
+	}
+	if s.MQPort != 0 {
+		values["mq-port"] = strconv.Itoa(s.MQPort)
+	}
+	if s.Username != "" {
+		values["mq-username"] = s.Username
+	}
+	if s.Password != "" {
+		values["mq-password"] = s.Password
+	}
+	if s.TopicPrefix != "" {
+		values["topic-prefix"] = s.TopicPrefix
+	}
+	if s.MQTT5 {
+		values["mqtt5"] = "true"
+	}
+	if s.ReconnectMax != 0 {
+		values["reconnect-max"] = s.ReconnectMax.String()
+	}
+	return values
+}
+
+// options returns the options for connecting to the tunnel's service,
+// using the given defaults for those which aren't set.
+//
+// Flags given upon the command-line, or via the environment, take
+// precedence, so values are only taken from the file when the flag
+// they correspond to isn't in the given set.
+func (t tunnelConfig) options(defaults upstreamOptions, set map[string]bool) upstreamOptions {
+	opts := defaults
+	if t.Timeout != 0 && !set["upstream-timeout"] {
+		opts.timeout = t.Timeout
+	}
+	if t.Insecure && !set["upstream-insecure"] {
+		opts.insecure = true
+	}
+	if t.CA != "" && !set["upstream-ca"] {
+		opts.caFile = t.CA
+	}
+	if t.SNI != "" && !set["upstream-sni"] {
+		opts.serverName = t.SNI
+	}
+	if t.Cert != "" && !set["upstream-cert"] {
+		opts.certFile = t.Cert
+	}
+	if t.Key != "" && !set["upstream-key"] {
+		opts.keyFile = t.Key
+	}
+	return opts
+}
+
+// tunnelOptions returns the options of the tunnel which we announce to
+// the server, using the given defaults for those which aren't set.
+//
+// As with options, flags in the given set take precedence.
+func (t tunnelConfig) tunnelOptions(defaults tunnelOptions, set map[string]bool) tunnelOptions {
+	opts := defaults
+	if t.Forwarded != "" && !set["forwarded-headers"] {
+		opts.forwarded = t.Forwarded
+	}
+	if len(t.Allow) > 0 && !set["allow"] {
+		opts.allow = t.Allow
+	}
+	if len(t.Deny) > 0 && !set["deny"] {
+		opts.deny = t.Deny
+	}
+	if len(t.Auth) > 0 && !set["auth"] {
+		opts.auth = t.Auth
+	}
+	if t.Htpasswd != "" && !set["htpasswd"] {
+		opts.htpasswd = t.Htpasswd
+	}
+	return opts
+}
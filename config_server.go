@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The server's configuration.
+//
+// The server may read a configuration file, for example:
+//
+//	port: 8080
+//	mq-port: 1883
+//	domains:
+//	  api.example.com: api
+//	deny:
+//	  - 192.0.2.0/24
+//	trusted-proxies:
+//	  - 10.0.0.0/8
+//	htpasswd: /etc/tunneller/htpasswd
+//	rate-limit:
+//	  requests: 10
+//	  burst: 20
+//	error-templates:
+//	  503: /etc/tunneller/503.html
+//
+// The settings which correspond to our flags are only read at startup,
+// but the remainder are re-read when we receive SIGHUP.  Each request
+// uses the settings which were current when it arrived, so reloading
+// doesn't affect those in-flight.
+//
+
+// serverConfig is the configuration file read by the server.
+type serverConfig struct {
+	//
+	// These settings correspond to our flags, and are only read
+	// at startup.
+	//
+	Host        string        `yaml:"host"`
+	Port        int           `yaml:"port"`
+	MQPort      int           `yaml:"mq-port"`
+	MQUsername  string        `yaml:"mq-username"`
+	MQPassword  string        `yaml:"mq-password"`
+	TopicPrefix string        `yaml:"topic-prefix"`
+	MQTT5       bool          `yaml:"mqtt5"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Drain       time.Duration `yaml:"drain-timeout"`
+	Admin       string        `yaml:"admin"`
+	OTLP        string        `yaml:"otlp-endpoint"`
+	ProxyProto  bool          `yaml:"proxy-protocol"`
+	LogLevel    string        `yaml:"log-level"`
+	LogFormat   string        `yaml:"log-format"`
+	AccessLog   struct {
+		Path    string `yaml:"path"`
+		Format  string `yaml:"format"`
+		MaxSize int64  `yaml:"max-size"`
+		Backups int    `yaml:"backups"`
+	} `yaml:"access-log"`
+
+	//
+	// These settings are reloaded upon SIGHUP.
+	//
+
+	// Domains maps hostnames to the name of the tunnel which serves
+	// them, allowing tunnels to be reached via their own domains.
+	Domains map[string]string `yaml:"domains"`
+
+	// Allow and Deny hold the CIDR ranges which visitors may, and
+	// may not, connect from.  If Allow is empty all visitors who
+	// aren't denied are allowed.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	// Htpasswd is the path to an htpasswd file listing the users who
+	// may access every tunnel.  If it is set visitors must authenticate
+	// as one of them, or as one of the users the tunnel announced.
+	Htpasswd string `yaml:"htpasswd"`
+
+	// TrustedProxies holds the CIDR ranges of the proxies whose
+	// X-Forwarded-For, and similar, headers we believe.
+	TrustedProxies []string `yaml:"trusted-proxies"`
+
+	// RateLimit limits the rate of requests made to each tunnel.
+	RateLimit struct {
+		// Requests is the number of requests permitted per second.
+		Requests float64 `yaml:"requests"`
+
+		// Burst is the number of requests permitted at once.
+		Burst int `yaml:"burst"`
+	} `yaml:"rate-limit"`
+
+	// ErrorTemplates maps HTTP status-codes to the paths of the
+	// templates used to show our error-pages.
+	ErrorTemplates map[int]string `yaml:"error-templates"`
+}
+
+// flagValues returns the values from the configuration which are set,
+// keyed by the name of the flag they correspond to.
+func (c serverConfig) flagValues() map[string]string {
+	values := make(map[string]string)
+	if c.Host != "" {
+		values["host"] = c.Host
+	}
+	if c.Port != 0 {
+		values["port"] = strconv.Itoa(c.Port)
+	}
+	if c.MQPort != 0 {
+		values["mq-port"] = strconv.Itoa(c.MQPort)
+	}
+	if c.MQUsername != "" {
+		values["mq-username"] = c.MQUsername
+	}
+	if c.MQPassword != "" {
+		values["mq-password"] = c.MQPassword
+	}
+	if c.TopicPrefix != "" {
+		values["topic-prefix"] = c.TopicPrefix
+	}
+	if c.MQTT5 {
+		values["mqtt5"] = "true"
+	}
+	if c.Timeout != 0 {
+		values["timeout"] = c.Timeout.String()
+	}
+	if c.Drain != 0 {
+		values["drain-timeout"] = c.Drain.String()
+	}
+	if c.Admin != "" {
+		values["admin"] = c.Admin
+	}
+	if c.ProxyProto {
+		values["proxy-protocol"] = "true"
+	}
+	if c.OTLP != "" {
+		values["otlp-endpoint"] = c.OTLP
+	}
+	if c.LogLevel != "" {
+		values["log-level"] = c.LogLevel
+	}
+	if c.LogFormat != "" {
+		values["log-format"] = c.LogFormat
+	}
+	if c.AccessLog.Path != "" {
+		values["access-log"] = c.AccessLog.Path
+	}
+	if c.AccessLog.Format != "" {
+		values["access-log-format"] = c.AccessLog.Format
+	}
+	if c.AccessLog.MaxSize != 0 {
+		values["access-log-max-size"] = strconv.FormatInt(c.AccessLog.MaxSize, 10)
+	}
+	if c.AccessLog.Backups != 0 {
+		values["access-log-backups"] = strconv.Itoa(c.AccessLog.Backups)
+	}
+	return values
+}
+
+// serverSettings holds the reloadable parts of our configuration, in the
+// form in which they're used.
+//
+// A new instance is created whenever the configuration is reloaded, and
+// an instance is never modified once it is in use, except for its
+// rate-limiters.
+type serverSettings struct {
+	// domains maps hostnames to the name of the tunnel serving them.
+	domains map[string]string
+
+	// access holds the networks visitors may, and may not, connect
+	// from.
+	access accessList
+
+	// users holds the users who may access every tunnel, and the
+	// bcrypt hashes of their passwords.
+	users map[string]string
+
+	// trusted holds the networks of the proxies we trust to tell us
+	// who their visitors are.
+	trusted []*net.IPNet
+
+	// limit and burst configure the rate-limiter of each tunnel.
+	limit rate.Limit
+	burst int
+
+	// limiters holds the rate-limiter of each tunnel, which are
+	// created as they're needed.
+	limiters map[string]*rate.Limiter
+
+	// limitersLock protects our limiters-map.
+	limitersLock sync.Mutex
+
+	// templates holds the templates for our error-pages, keyed by
+	// HTTP status-code.
+	templates map[int]*template.Template
+}
+
+// defaultErrorTemplate is the template used for error-pages which have
+// no template configured.
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+// newServerSettings creates our settings from the given configuration.
+func newServerSettings(cfg serverConfig) (*serverSettings, error) {
+
+	s := &serverSettings{
+		domains:   make(map[string]string),
+		limit:     rate.Inf,
+		limiters:  make(map[string]*rate.Limiter),
+		templates: make(map[int]*template.Template),
+	}
+
+	for domain, name := range cfg.Domains {
+		if err := validTopicName(name); err != nil {
+			return nil, fmt.Errorf("invalid tunnel for the domain %s: %s", domain, err.Error())
+		}
+		s.domains[strings.ToLower(domain)] = name
+	}
+
+	var err error
+	if s.access, err = newAccessList(cfg.Allow, cfg.Deny); err != nil {
+		return nil, err
+	}
+	if s.trusted, err = parseNetworks(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.Htpasswd != "" {
+		if s.users, err = loadHtpasswd(cfg.Htpasswd); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.RateLimit.Requests > 0 {
+		s.limit = rate.Limit(cfg.RateLimit.Requests)
+		s.burst = cfg.RateLimit.Burst
+		if s.burst < 1 {
+			s.burst = 1
+		}
+	}
+
+	for status, path := range cfg.ErrorTemplates {
+		tmpl, tmplErr := template.ParseFiles(path)
+		if tmplErr != nil {
+			return nil, fmt.Errorf("failed to load the template for %d: %s", status, tmplErr.Error())
+		}
+		s.templates[status] = tmpl
+	}
+	return s, nil
+}
+
+// tunnelFor returns the name of the tunnel which serves the given host,
+// which may include a port.
+//
+// If the host isn't mapped to a tunnel then the tunnel is named by the
+// first label of the host, i.e. "foo.tunnel.steve.fi" is served by the
+// tunnel "foo".
+func (s *serverSettings) tunnelFor(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if name, ok := s.domains[host]; ok {
+		return name
+	}
+	if strings.Contains(host, ".") {
+		host = strings.Split(host, ".")[0]
+	}
+	return host
+}
+
+// permitted returns true if the visitor at the given address may make
+// requests.
+func (s *serverSettings) permitted(address string) bool {
+	return s.access.permitted(address)
+}
+
+// allowRequest returns true if a request may be made to the named tunnel
+// without exceeding its rate-limit.
+//
+// A limiter is created for each name we're given, so the name must be
+// that of a tunnel which has been announced, or otherTunnel for all the
+// others, lest visitors create limiters without limit by making requests
+// to random hostnames.
+func (s *serverSettings) allowRequest(name string) bool {
+	if s.limit == rate.Inf {
+		return true
+	}
+
+	s.limitersLock.Lock()
+	limiter, ok := s.limiters[name]
+	if !ok {
+		limiter = rate.NewLimiter(s.limit, s.burst)
+		s.limiters[name] = limiter
+	}
+	s.limitersLock.Unlock()
+
+	return limiter.Allow()
+}
+
+// errorPage sends an error-page to the visitor, using the template for
+// the given status-code if there is one.
+func (s *serverSettings) errorPage(w http.ResponseWriter, status int, tunnel string, message string) {
+
+	tmpl, ok := s.templates[status]
+	if !ok {
+		tmpl = defaultErrorTemplate
+	}
+
+	data := struct {
+		Status     int
+		StatusText string
+		Tunnel     string
+		Message    string
+	}{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Tunnel:     tunnel,
+		Message:    message,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(status)
+	tmpl.Execute(w, data)
+}
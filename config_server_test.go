@@ -0,0 +1,317 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServerConfig is the configuration file our server tests read.
+const testServerConfig = `
+port: 8081
+mq-port: 1884
+mq-username: file
+timeout: 5s
+domains:
+  API.example.com: api
+rate-limit:
+  requests: 1
+  burst: 2
+`
+
+// configureServer writes the given configuration file, and configures a
+// server from it, and the given command-line arguments, as Execute does.
+func configureServer(t *testing.T, config string, args ...string) (*serveCmd, serverConfig, error) {
+	t.Helper()
+
+	p := &serveCmd{}
+	f := flag.NewFlagSet("serve", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse(append([]string{"-config", writeConfig(t, config)}, args...)); err != nil {
+		t.Fatalf("failed to parse %v: %s", args, err)
+	}
+
+	set := flagsSet(f)
+	if err := applyEnv(f, set); err != nil {
+		return p, serverConfig{}, err
+	}
+	cfg, err := p.loadConfig()
+	if err != nil {
+		return p, cfg, err
+	}
+	return p, cfg, applyValues(f, set, cfg.flagValues())
+}
+
+// TestServerPrecedence tests that flags take precedence over environment
+// variables, which take precedence over the configuration file.
+func TestServerPrecedence(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		port     int
+		mqPort   int
+		username string
+		timeout  time.Duration
+	}{
+		{
+			name:     "file",
+			port:     8081,
+			mqPort:   1884,
+			username: "file",
+			timeout:  5 * time.Second,
+		},
+		{
+			name:     "environment",
+			env:      map[string]string{"TUNNELLER_PORT": "8082", "TUNNELLER_MQ_USERNAME": "env"},
+			port:     8082,
+			mqPort:   1884,
+			username: "env",
+			timeout:  5 * time.Second,
+		},
+		{
+			name:     "flags",
+			args:     []string{"-port", "8083", "-mq-username", "flag", "-timeout", "1m"},
+			env:      map[string]string{"TUNNELLER_PORT": "8082", "TUNNELLER_MQ_USERNAME": "env"},
+			port:     8083,
+			mqPort:   1884,
+			username: "flag",
+			timeout:  time.Minute,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			for name, value := range tst.env {
+				t.Setenv(name, value)
+			}
+
+			p, _, err := configureServer(t, testServerConfig, tst.args...)
+			if err != nil {
+				t.Fatalf("failed to configure the server: %s", err)
+			}
+			if p.bindPort != tst.port {
+				t.Errorf("the port was %d, expected %d", p.bindPort, tst.port)
+			}
+			if p.mqPort != tst.mqPort {
+				t.Errorf("the MQ port was %d, expected %d", p.mqPort, tst.mqPort)
+			}
+			if p.mqUsername != tst.username {
+				t.Errorf("the username was %q, expected %q", p.mqUsername, tst.username)
+			}
+			if p.timeout != tst.timeout {
+				t.Errorf("the timeout was %s, expected %s", p.timeout, tst.timeout)
+			}
+		})
+	}
+}
+
+// TestServerConfigErrors tests the configurations the server refuses.
+func TestServerConfigErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+	}{
+		{"unknown-key", "ports: 8080\n", nil},
+		{"invalid-value", "port: many\n", nil},
+		{"invalid-environment", "", map[string]string{"TUNNELLER_TIMEOUT": "soon"}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			for name, value := range tst.env {
+				t.Setenv(name, value)
+			}
+			if _, _, err := configureServer(t, tst.config); err == nil {
+				t.Errorf("the configuration was accepted")
+			}
+		})
+	}
+}
+
+// TestNewServerSettings tests the reloadable settings the server refuses.
+func TestNewServerSettings(t *testing.T) {
+
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"empty", "", true},
+		{"valid", testServerConfig, true},
+		{"invalid-domain", "domains:\n  example.com: a/b\n", false},
+		{"reserved-domain", "domains:\n  example.com: _server\n", false},
+		{"invalid-allow", "allow: [10.0.0.0/33]\n", false},
+		{"invalid-deny", "deny: [nonsense]\n", false},
+		{"invalid-trusted", "trusted-proxies: [nonsense]\n", false},
+		{"missing-htpasswd", "htpasswd: " + missing + "\n", false},
+		{"missing-template", "error-templates:\n  503: " + missing + "\n", false},
+	}
+
+	for _, tst := range tests {
+		_, cfg, err := configureServer(t, tst.config)
+		if err != nil {
+			t.Fatalf("%s: failed to read the configuration: %s", tst.name, err)
+		}
+		_, err = newServerSettings(cfg)
+		if (err == nil) != tst.valid {
+			t.Errorf("%s: newServerSettings gave error %v, expected valid=%v", tst.name, err, tst.valid)
+		}
+	}
+}
+
+// TestReload tests that reloading an invalid configuration leaves the
+// current settings in use.
+func TestReload(t *testing.T) {
+
+	p, _, err := configureServer(t, testServerConfig)
+	if err != nil {
+		t.Fatalf("failed to configure the server: %s", err)
+	}
+	if err = p.reload(); err != nil {
+		t.Fatalf("failed to load the configuration: %s", err)
+	}
+	if name := p.settings.Load().tunnelFor("api.example.com"); name != "api" {
+		t.Fatalf("api.example.com is served by %q", name)
+	}
+
+	//
+	// Break the configuration, and reload it.
+	//
+	if err = os.WriteFile(p.config, []byte("deny: [nonsense]\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", p.config, err)
+	}
+	if err = p.reload(); err == nil {
+		t.Errorf("an invalid configuration was loaded")
+	}
+	if name := p.settings.Load().tunnelFor("api.example.com"); name != "api" {
+		t.Errorf("after a failed reload api.example.com is served by %q", name)
+	}
+
+	//
+	// Fix it, changing the domains.
+	//
+	if err = os.WriteFile(p.config, []byte("domains:\n  api.example.com: other\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", p.config, err)
+	}
+	if err = p.reload(); err != nil {
+		t.Errorf("failed to reload the configuration: %s", err)
+	}
+	if name := p.settings.Load().tunnelFor("api.example.com"); name != "other" {
+		t.Errorf("after reloading api.example.com is served by %q", name)
+	}
+}
+
+// TestTunnelFor tests finding the tunnel which serves a host.
+func TestTunnelFor(t *testing.T) {
+
+	settings, err := newServerSettings(serverConfig{Domains: map[string]string{"API.example.com": "api"}})
+	if err != nil {
+		t.Fatalf("failed to create the settings: %s", err)
+	}
+
+	tests := []struct {
+		host   string
+		tunnel string
+	}{
+		{"foo.tunnel.example.com", "foo"},
+		{"FOO.tunnel.example.com", "foo"},
+		{"foo.tunnel.example.com:8080", "foo"},
+		{"foo", "foo"},
+		{"api.example.com", "api"},
+		{"Api.Example.Com:443", "api"},
+		{"www.api.example.com", "www"},
+	}
+
+	for _, tst := range tests {
+		if out := settings.tunnelFor(tst.host); out != tst.tunnel {
+			t.Errorf("tunnelFor(%q) gave %q, expected %q", tst.host, out, tst.tunnel)
+		}
+	}
+}
+
+// TestAllowRequest tests the rate-limiting of each tunnel.
+func TestAllowRequest(t *testing.T) {
+
+	var cfg serverConfig
+	cfg.RateLimit.Requests = 0.001
+	cfg.RateLimit.Burst = 2
+
+	limited, err := newServerSettings(cfg)
+	if err != nil {
+		t.Fatalf("failed to create the settings: %s", err)
+	}
+	unlimited, err := newServerSettings(serverConfig{})
+	if err != nil {
+		t.Fatalf("failed to create the settings: %s", err)
+	}
+
+	tests := []struct {
+		settings *serverSettings
+		tunnel   string
+		result   bool
+	}{
+		{limited, "foo", true},
+		{limited, "foo", true},
+		{limited, "foo", false},
+		{limited, "bar", true},
+		{limited, "bar", true},
+		{limited, "bar", false},
+		{limited, otherTunnel, true},
+		{unlimited, "foo", true},
+		{unlimited, "foo", true},
+		{unlimited, "foo", true},
+	}
+
+	for i, tst := range tests {
+		if out := tst.settings.allowRequest(tst.tunnel); out != tst.result {
+			t.Errorf("%d: allowRequest(%q) gave %v, expected %v", i, tst.tunnel, out, tst.result)
+		}
+	}
+}
+
+// TestErrorTemplates tests that our error-pages use the configured
+// templates.
+func TestErrorTemplates(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "503.html")
+	if err := os.WriteFile(path, []byte("{{.Status}} {{.StatusText}} {{.Tunnel}}: {{.Message}}"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+
+	settings, err := newServerSettings(serverConfig{ErrorTemplates: map[int]string{http.StatusServiceUnavailable: path}})
+	if err != nil {
+		t.Fatalf("failed to create the settings: %s", err)
+	}
+
+	tests := []struct {
+		status   int
+		message  string
+		expected string
+	}{
+		{http.StatusServiceUnavailable, "Gone <away>", "503 Service Unavailable foo: Gone &lt;away&gt;"},
+		{http.StatusBadGateway, "Broken", "<p>Broken</p>"},
+	}
+
+	for _, tst := range tests {
+		rec := httptest.NewRecorder()
+		settings.errorPage(rec, tst.status, "foo", tst.message)
+
+		if rec.Code != tst.status {
+			t.Errorf("%d: the status was %d", tst.status, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), tst.expected) {
+			t.Errorf("%d: the page %q doesn't contain %q", tst.status, rec.Body.String(), tst.expected)
+		}
+	}
+}
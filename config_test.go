@@ -0,0 +1,341 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testClientConfig is the configuration file our client tests read.
+const testClientConfig = `
+tunnels:
+  web:
+    expose: localhost:8080
+    upstream-timeout: 5s
+    upstream-insecure: true
+    upstream-sni: file.example.com
+    forwarded-headers: x-forwarded
+    allow: [10.0.0.0/8]
+    deny: [10.0.0.1]
+    auth: ["file:secret"]
+    htpasswd: /file/htpasswd
+`
+
+// writeConfig writes the given configuration file, returning its path.
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+	return path
+}
+
+// configureClient writes the given configuration file, and configures a
+// client from it and the given command-line arguments.
+func configureClient(t *testing.T, config string, args ...string) (*clientCmd, []namedTunnel, map[string]bool, error) {
+	t.Helper()
+
+	p := &clientCmd{}
+	f := flag.NewFlagSet("client", flag.ContinueOnError)
+	p.SetFlags(f)
+	if err := f.Parse(append([]string{"-config", writeConfig(t, config)}, args...)); err != nil {
+		t.Fatalf("failed to parse %v: %s", args, err)
+	}
+
+	tunnels, set, err := p.configure(f)
+	return p, tunnels, set, err
+}
+
+// TestTunnelPrecedence tests that flags, and environment variables, take
+// precedence over the settings of the tunnels in the configuration file.
+func TestTunnelPrecedence(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		upstream upstreamOptions
+		tunnel   tunnelOptions
+	}{
+		{
+			name: "file",
+			args: []string{"web"},
+			upstream: upstreamOptions{
+				timeout:    5 * time.Second,
+				insecure:   true,
+				serverName: "file.example.com",
+			},
+			tunnel: tunnelOptions{
+				forwarded: forwardedX,
+				allow:     []string{"10.0.0.0/8"},
+				deny:      []string{"10.0.0.1"},
+				auth:      []string{"file:secret"},
+				htpasswd:  "/file/htpasswd",
+			},
+		},
+		{
+			name: "flags",
+			args: []string{
+				"-upstream-timeout", "60s",
+				"-upstream-insecure=false",
+				"-upstream-sni", "flag.example.com",
+				"-forwarded-headers", "none",
+				"-allow", "1.2.3.4",
+				"-deny", "5.6.7.8",
+				"-auth", "flag:secret",
+				"-htpasswd", "/flag/htpasswd",
+				"web",
+			},
+			upstream: upstreamOptions{
+				timeout:    60 * time.Second,
+				serverName: "flag.example.com",
+			},
+			tunnel: tunnelOptions{
+				forwarded: forwardedNone,
+				allow:     []string{"1.2.3.4"},
+				deny:      []string{"5.6.7.8"},
+				auth:      []string{"flag:secret"},
+				htpasswd:  "/flag/htpasswd",
+			},
+		},
+		{
+			name: "environment",
+			args: []string{"-upstream-sni", "flag.example.com", "web"},
+			env: map[string]string{
+				"TUNNELLER_UPSTREAM_TIMEOUT":  "45s",
+				"TUNNELLER_UPSTREAM_SNI":      "env.example.com",
+				"TUNNELLER_FORWARDED_HEADERS": "forwarded",
+			},
+			upstream: upstreamOptions{
+				timeout:    45 * time.Second,
+				insecure:   true,
+				serverName: "flag.example.com",
+			},
+			tunnel: tunnelOptions{
+				forwarded: forwardedRFC,
+				allow:     []string{"10.0.0.0/8"},
+				deny:      []string{"10.0.0.1"},
+				auth:      []string{"file:secret"},
+				htpasswd:  "/file/htpasswd",
+			},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			for name, value := range tst.env {
+				t.Setenv(name, value)
+			}
+
+			p, tunnels, set, err := configureClient(t, testClientConfig, tst.args...)
+			if err != nil {
+				t.Fatalf("failed to configure the client: %s", err)
+			}
+			if len(tunnels) != 1 {
+				t.Fatalf("expected one tunnel, got %d", len(tunnels))
+			}
+
+			upstream := tunnels[0].config.options(p.upstreamOpts, set)
+			if upstream != tst.upstream {
+				t.Errorf("upstream options were %+v, expected %+v", upstream, tst.upstream)
+			}
+			opts := tunnels[0].config.tunnelOptions(p.tunnelOpts, set)
+			if !reflect.DeepEqual(opts, tst.tunnel) {
+				t.Errorf("tunnel options were %+v, expected %+v", opts, tst.tunnel)
+			}
+		})
+	}
+}
+
+// testServersConfig is the configuration file, of servers and profiles,
+// our client tests read.
+const testServersConfig = `
+servers:
+  home:
+    tunnel: home.example.com
+    mq-port: 1884
+    username: file
+  work:
+    tunnel: work.example.com
+    topic-prefix: acme/dev
+tunnels:
+  api:
+    expose: localhost:8080
+  web:
+    expose: localhost:8000
+profiles:
+  home:
+    server: home
+    tunnels: [api]
+  work:
+    server: work
+    tunnels: [api, web]
+default: home
+`
+
+// TestClientPrecedence tests that flags take precedence over environment
+// variables, which take precedence over the configuration file.
+func TestClientPrecedence(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		tunnel   string
+		port     int
+		username string
+		prefix   string
+		tunnels  []string
+	}{
+		{
+			name:     "default-profile",
+			tunnel:   "home.example.com",
+			port:     1884,
+			username: "file",
+			prefix:   defaultTopicPrefix,
+			tunnels:  []string{"api"},
+		},
+		{
+			name:    "named-profile",
+			args:    []string{"-profile", "work"},
+			tunnel:  "work.example.com",
+			port:    1883,
+			prefix:  "acme/dev",
+			tunnels: []string{"api", "web"},
+		},
+		{
+			name:     "named-tunnels",
+			args:     []string{"web"},
+			tunnel:   "home.example.com",
+			port:     1884,
+			username: "file",
+			prefix:   defaultTopicPrefix,
+			tunnels:  []string{"web"},
+		},
+		{
+			name:     "environment",
+			env:      map[string]string{"TUNNELLER_MQ_PORT": "1885", "TUNNELLER_MQ_USERNAME": "env"},
+			tunnel:   "home.example.com",
+			port:     1885,
+			username: "env",
+			prefix:   defaultTopicPrefix,
+			tunnels:  []string{"api"},
+		},
+		{
+			name:     "flags",
+			args:     []string{"-tunnel", "flag.example.com", "-mq-port", "1886", "-mq-username", "flag"},
+			env:      map[string]string{"TUNNELLER_MQ_PORT": "1885", "TUNNELLER_MQ_USERNAME": "env"},
+			tunnel:   "flag.example.com",
+			port:     1886,
+			username: "flag",
+			prefix:   defaultTopicPrefix,
+			tunnels:  []string{"api"},
+		},
+		{
+			name:     "expose-without-profile",
+			args:     []string{"-expose", "localhost:9000"},
+			tunnel:   "home.example.com",
+			port:     1884,
+			username: "file",
+			prefix:   defaultTopicPrefix,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			for name, value := range tst.env {
+				t.Setenv(name, value)
+			}
+
+			p, tunnels, _, err := configureClient(t, testServersConfig, tst.args...)
+			if err != nil {
+				t.Fatalf("failed to configure the client: %s", err)
+			}
+
+			if p.tunnel != tst.tunnel {
+				t.Errorf("the tunnel was %q, expected %q", p.tunnel, tst.tunnel)
+			}
+			if p.mqPort != tst.port {
+				t.Errorf("the port was %d, expected %d", p.mqPort, tst.port)
+			}
+			if p.mqUsername != tst.username {
+				t.Errorf("the username was %q, expected %q", p.mqUsername, tst.username)
+			}
+			if p.topicPrefix != tst.prefix {
+				t.Errorf("the topic-prefix was %q, expected %q", p.topicPrefix, tst.prefix)
+			}
+
+			var names []string
+			for _, ent := range tunnels {
+				names = append(names, ent.name)
+			}
+			if !reflect.DeepEqual(names, tst.tunnels) {
+				t.Errorf("the tunnels were %v, expected %v", names, tst.tunnels)
+			}
+		})
+	}
+}
+
+// TestClientConfigErrors tests the configurations the client refuses.
+func TestClientConfigErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		env    map[string]string
+	}{
+		{"unknown-profile", testServersConfig, []string{"-profile", "missing"}, nil},
+		{"unknown-tunnel", testServersConfig, []string{"missing"}, nil},
+		{"unknown-server", "profiles:\n  p:\n    server: missing\ndefault: p\n", nil, nil},
+		{"unknown-key", "tunnels:\n  api:\n    exposed: localhost:8080\n", nil, nil},
+		{"invalid-yaml", "tunnels: [", nil, nil},
+		{"invalid-value", "servers:\n  s:\n    mq-port: many\n", nil, nil},
+		{"invalid-environment", "", nil, map[string]string{"TUNNELLER_MQ_PORT": "many"}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			for name, value := range tst.env {
+				t.Setenv(name, value)
+			}
+			if _, _, _, err := configureClient(t, tst.config, tst.args...); err == nil {
+				t.Errorf("the configuration was accepted")
+			}
+		})
+	}
+}
+
+// TestLoadConfig tests reading configuration files which may be missing,
+// or empty.
+func TestLoadConfig(t *testing.T) {
+
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+
+	tests := []struct {
+		name     string
+		path     string
+		optional bool
+		valid    bool
+	}{
+		{"missing-optional", missing, true, true},
+		{"missing-required", missing, false, false},
+		{"empty", writeConfig(t, ""), false, true},
+		{"comments", writeConfig(t, "# nothing to see here\n"), false, true},
+		{"document-marker", writeConfig(t, "---\n"), false, true},
+		{"valid", writeConfig(t, testServersConfig), false, true},
+	}
+
+	for _, tst := range tests {
+		var cfg clientConfig
+		err := loadConfig(tst.path, tst.optional, &cfg)
+		if (err == nil) != tst.valid {
+			t.Errorf("%s: loadConfig gave error %v, expected valid=%v", tst.name, err, tst.valid)
+		}
+	}
+}
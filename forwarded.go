@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarding headers.
+//
+// The server tells the service a client exposes who made each request,
+// and how, by adding the X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host headers, and the RFC 7239 Forwarded header, to the
+// requests it sends.  Each tunnel announces which of these it wants.
+//
+// Such headers sent by visitors are discarded, unless the visitor is one
+// of the proxies the server is configured to trust, in which case we add
+// ourselves to them.
+//
+
+// The sets of forwarding headers a tunnel may ask for.
+const (
+	forwardedAll  = "all"
+	forwardedX    = "x-forwarded"
+	forwardedRFC  = "forwarded"
+	forwardedNone = "none"
+)
+
+// forwardedHeader is the name of the RFC 7239 header.
+const forwardedHeader = "Forwarded"
+
+// validForwarded returns an error if the given set of forwarding headers
+// isn't one we understand.
+func validForwarded(mode string) error {
+	switch mode {
+	case forwardedAll, forwardedX, forwardedRFC, forwardedNone:
+		return nil
+	}
+	return fmt.Errorf("invalid forwarded-headers %s, expected one of %s, %s, %s, or %s", mode, forwardedAll, forwardedX, forwardedRFC, forwardedNone)
+}
+
+// setForwardedHeaders replaces the forwarding headers of the given request,
+// received from a visitor, with those of the given set.
+//
+// If the visitor is one of the trusted proxies the headers it sent are
+// extended, otherwise they're discarded.
+//
+// Tunnels which don't say which headers they want are given them all.
+func setForwardedHeaders(r *http.Request, mode string, trusted []*net.IPNet) {
+
+	if mode == "" {
+		mode = forwardedAll
+	}
+
+	peer := parseAddress(r.RemoteAddr)
+	if peer == "" {
+		peer = r.RemoteAddr
+	}
+	fromProxy := containsIP(trusted, net.ParseIP(peer))
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	host := r.Host
+
+	//
+	// The Forwarded header describes each hop, so our element
+	// describes the request we received, whereas the X-Forwarded
+	// headers describe the visitor's original request.
+	//
+	forwardedFor := peer
+	forwarded := forwardedElement(peer, host, proto)
+
+	if fromProxy {
+		if value := r.Header.Get("X-Forwarded-Proto"); value == "http" || value == "https" {
+			proto = value
+		}
+		if value := r.Header.Get("X-Forwarded-Host"); value != "" {
+			host = value
+		}
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			forwardedFor = strings.Join(values, ", ") + ", " + peer
+		}
+		if values := r.Header.Values(forwardedHeader); len(values) > 0 {
+			forwarded = strings.Join(values, ", ") + ", " + forwarded
+		}
+	}
+
+	for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", forwardedHeader} {
+		r.Header.Del(name)
+	}
+
+	if mode == forwardedAll || mode == forwardedX {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		r.Header.Set("X-Forwarded-Proto", proto)
+		r.Header.Set("X-Forwarded-Host", host)
+	}
+	if mode == forwardedAll || mode == forwardedRFC {
+		r.Header.Set(forwardedHeader, forwarded)
+	}
+}
+
+// forwardedElement returns the element of the Forwarded header describing
+// a request from the given address, to the given host, via the given
+// protocol.
+//
+// IPv6 addresses must be bracketed and quoted, and we always quote the
+// host as it may contain a port.
+func forwardedElement(address string, host string, proto string) string {
+	node := address
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	return fmt.Sprintf("for=%s;host=%s;proto=%s", node, quoteForwarded(host), proto)
+}
+
+// quoteForwarded returns the given value as an RFC 7230 quoted-string.
+func quoteForwarded(value string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range []byte(value) {
+		if c == '"' || c == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(c)
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestSetForwardedHeaders tests the forwarding headers we send to the
+// services our clients expose.
+func TestSetForwardedHeaders(t *testing.T) {
+
+	trusted := mustNetworks(t, "10.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		peer    string
+		mode    string
+		tls     bool
+		headers map[string]string
+
+		// The headers we expect, where "" means the header
+		// must be absent.
+		expected map[string]string
+	}{
+		{
+			name: "default",
+			peer: "1.2.3.4:1234",
+			expected: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"Forwarded":         `for=1.2.3.4;host="example.com";proto=http`,
+			},
+		},
+		{
+			name: "tls-ipv6",
+			peer: "[2001:db8::1]:1234",
+			mode: forwardedAll,
+			tls:  true,
+			expected: map[string]string{
+				"X-Forwarded-For":   "2001:db8::1",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         `for="[2001:db8::1]";host="example.com";proto=https`,
+			},
+		},
+		{
+			name: "mapped-ipv4",
+			peer: "[::ffff:1.2.3.4]:1234",
+			expected: map[string]string{
+				"X-Forwarded-For": "1.2.3.4",
+				"Forwarded":       `for=1.2.3.4;host="example.com";proto=http`,
+			},
+		},
+		{
+			name: "zoned-ipv6",
+			peer: "[fe80::1%eth0]:1234",
+			expected: map[string]string{
+				"X-Forwarded-For": "fe80::1",
+				"Forwarded":       `for="[fe80::1]";host="example.com";proto=http`,
+			},
+		},
+		{
+			name: "mapped-trusted-proxy",
+			peer: "[::ffff:10.0.0.1]:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "5.6.7.8",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For": "5.6.7.8, 10.0.0.1",
+			},
+		},
+		{
+			name: "x-forwarded-only",
+			peer: "1.2.3.4:1234",
+			mode: forwardedX,
+			expected: map[string]string{
+				"X-Forwarded-For": "1.2.3.4",
+				"Forwarded":       "",
+			},
+		},
+		{
+			name: "forwarded-only",
+			peer: "1.2.3.4:1234",
+			mode: forwardedRFC,
+			expected: map[string]string{
+				"X-Forwarded-For": "",
+				"Forwarded":       `for=1.2.3.4;host="example.com";proto=http`,
+			},
+		},
+		{
+			name: "none",
+			peer: "1.2.3.4:1234",
+			mode: forwardedNone,
+			headers: map[string]string{
+				"X-Forwarded-For": "5.6.7.8",
+				"Forwarded":       "for=5.6.7.8",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For":   "",
+				"X-Forwarded-Proto": "",
+				"X-Forwarded-Host":  "",
+				"Forwarded":         "",
+			},
+		},
+		{
+			name: "untrusted-discarded",
+			peer: "1.2.3.4:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":   "5.6.7.8",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "evil.example.com",
+				"Forwarded":         "for=5.6.7.8",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"Forwarded":         `for=1.2.3.4;host="example.com";proto=http`,
+			},
+		},
+		{
+			name: "trusted-extended",
+			peer: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":   "5.6.7.8",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "www.example.com",
+				"Forwarded":         "for=5.6.7.8",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For":   "5.6.7.8, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "www.example.com",
+				"Forwarded":         `for=5.6.7.8, for=10.0.0.1;host="example.com";proto=http`,
+			},
+		},
+		{
+			name: "trusted-bogus-proto",
+			peer: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "gopher",
+			},
+			expected: map[string]string{
+				"X-Forwarded-For":   "10.0.0.1",
+				"X-Forwarded-Proto": "http",
+			},
+		},
+	}
+
+	for _, tst := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tst.peer
+		if tst.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		for name, value := range tst.headers {
+			req.Header.Set(name, value)
+		}
+
+		setForwardedHeaders(req, tst.mode, trusted)
+
+		for name, value := range tst.expected {
+			if out := req.Header.Get(name); out != value {
+				t.Errorf("%s: %s was %q, expected %q", tst.name, name, out, value)
+			}
+		}
+	}
+}
+
+// TestQuoteForwarded tests the quoting of values within the Forwarded
+// header.
+func TestQuoteForwarded(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"example.com", `"example.com"`},
+		{"example.com:8080", `"example.com:8080"`},
+		{`a"b\c`, `"a\"b\\c"`},
+	}
+
+	for _, tst := range tests {
+		if out := quoteForwarded(tst.input); out != tst.output {
+			t.Errorf("quoteForwarded(%q) gave %q, expected %q", tst.input, out, tst.output)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logOptions holds the options which configure our logging.
+//
+// Both the server and the client log via a structured logger, either as
+// text or as JSON.  The client's GUI occupies the terminal, so it only
+// logs if it is given a file to log to.
+type logOptions struct {
+	// level is the minimum level of the messages we log.
+	level string
+
+	// format is either "text" or "json".
+	format string
+
+	// file is the path to the file we log to, if any.
+	file string
+}
+
+// SetFlags configures the flags which set our options.
+//
+// If withFile is true a flag is added to specify the file to log to.
+func (o *logOptions) SetFlags(f *flag.FlagSet, withFile bool) {
+	f.StringVar(&o.level, "log-level", "info", "The minimum level of the messages to log: debug, info, warn, or error.")
+	f.StringVar(&o.format, "log-format", "text", "The format of our log messages: text, or json.")
+	if withFile {
+		f.StringVar(&o.file, "log-file", "", "The file to log to, if any.")
+	}
+}
+
+// newLogger creates a logger with our options.
+//
+// If we have a file we log to it, otherwise we log to the given writer.
+// The returned function closes the file, if we opened one.
+func (o *logOptions) newLogger(w io.Writer) (*slog.Logger, func(), error) {
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.level)); err != nil {
+		return nil, nil, fmt.Errorf("invalid log-level %s", o.level)
+	}
+
+	closer := func() {}
+	if o.file != "" {
+		file, err := os.OpenFile(o.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = file
+		closer = func() { file.Close() }
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch o.format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		closer()
+		return nil, nil, fmt.Errorf("invalid log-format %s", o.format)
+	}
+	return slog.New(handler), closer, nil
+}
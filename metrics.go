@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Our metrics, which the server serves via /metrics upon its admin
+// listener, and the client serves via /metrics upon the address given
+// by its -metrics flag.
+//
+// The server labels requests with the name of the tunnel they were made
+// to, but only if a client has announced that tunnel.  Requests to other
+// names are labeled "_other", so that visitors can't create an unbounded
+// number of series by making requests to random hostnames.
+//
+
+// otherTunnel is the label used for requests to tunnels which haven't
+// been announced.  Tunnel names may not begin with "_", so this can't
+// clash with a real tunnel.
+const otherTunnel = "_other"
+
+// serverMetrics holds the metrics the server exports.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests   *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	timeouts   *prometheus.CounterVec
+	rejected   *prometheus.CounterVec
+	bytesIn    *prometheus.CounterVec
+	bytesOut   *prometheus.CounterVec
+	inFlight   prometheus.Gauge
+	reconnects prometheus.Counter
+}
+
+// newServerMetrics creates the metrics for the given server.
+func newServerMetrics(p *serveCmd) *serverMetrics {
+
+	m := &serverMetrics{registry: prometheus.NewRegistry()}
+
+	m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_requests_total",
+		Help: "The number of requests handled, by tunnel and status-code.",
+	}, []string{"tunnel", "code"})
+
+	m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tunneller_request_duration_seconds",
+		Help:    "The time taken to handle requests, by tunnel.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tunnel"})
+
+	m.timeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_timeouts_total",
+		Help: "The number of requests which the client didn't reply to in time, by tunnel.",
+	}, []string{"tunnel"})
+
+	m.rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_rejected_requests_total",
+		Help: "The number of requests rejected by an access-list, or rate-limit, by tunnel and reason.",
+	}, []string{"tunnel", "reason"})
+
+	m.bytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_request_bytes_total",
+		Help: "The size of the request bodies received from visitors, by tunnel.",
+	}, []string{"tunnel"})
+
+	m.bytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_response_bytes_total",
+		Help: "The size of the response bodies sent to visitors, by tunnel.",
+	}, []string{"tunnel"})
+
+	m.inFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tunneller_requests_in_flight",
+		Help: "The number of requests currently being handled.",
+	})
+
+	m.reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tunneller_broker_reconnects_total",
+		Help: "The number of times we've reconnected to the broker.",
+	})
+
+	tunnels := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tunneller_active_tunnels",
+		Help: "The number of tunnels which clients have announced.",
+	}, func() float64 {
+		p.clientsLock.Lock()
+		defer p.clientsLock.Unlock()
+		return float64(len(p.clients))
+	})
+
+	connected := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tunneller_broker_connected",
+		Help: "Whether we're connected to the broker.",
+	}, func() float64 {
+		if p.connected.Load() {
+			return 1
+		}
+		return 0
+	})
+
+	m.registry.MustRegister(
+		m.requests, m.latency, m.timeouts, m.rejected, m.bytesIn, m.bytesOut,
+		m.inFlight, m.reconnects, tunnels, connected,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler returns the handler which serves our metrics.
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// tunnelLabel returns the label to use for requests to the named tunnel.
+func (p *serveCmd) tunnelLabel(name string) string {
+	if _, ok := p.client(name); ok {
+		return name
+	}
+	return otherTunnel
+}
+
+// instrument wraps the given handler, recording the metrics for each
+// request it handles, and logging it, and recording it in our access
+// log if we have one.
+func (p *serveCmd) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		m := p.metrics
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		start := time.Now()
+		ip := RemoteIP(r, p.settings.Load().trusted)
+
+		info := &requestInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		//
+		// We record the user now, as their credentials are removed
+		// if we authenticate them.
+		//
+		user, _, _ := r.BasicAuth()
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		//
+		// We determine the label after the request has been handled,
+		// so that the first request to a tunnel whose client has
+		// just announced itself is counted against it.
+		//
+		label := p.tunnelLabel(p.settings.Load().tunnelFor(r.Host))
+		m.requests.WithLabelValues(label, strconv.Itoa(rec.status)).Inc()
+		m.latency.WithLabelValues(label).Observe(duration.Seconds())
+		m.bytesIn.WithLabelValues(label).Add(float64(body.count))
+		m.bytesOut.WithLabelValues(label).Add(float64(rec.count))
+
+		p.log.Info("request",
+			"tunnel", info.tunnel,
+			"id", info.id,
+			"request_id", info.requestID,
+			"ip", ip,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.count,
+			"duration", duration)
+
+		logErr := p.accessLog.Log(accessEntry{
+			Time:      start,
+			Tunnel:    info.tunnel,
+			ID:        info.id,
+			RequestID: info.requestID,
+			RemoteIP:  ip,
+			User:      user,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    rec.status,
+			Bytes:     rec.count,
+			Duration:  duration,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+		if logErr != nil {
+			p.log.Error("failed to write to the access log", "error", logErr)
+		}
+	})
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+// Read reads from the body, counting the bytes read.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// statusRecorder records the status-code, and the number of bytes, of a
+// response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	count       int64
+	wroteHeader bool
+}
+
+// WriteHeader records the status-code of the response.
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the number of bytes written.
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(p)
+	s.count += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter, so that its optional
+// interfaces may be used via http.ResponseController.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// clientMetrics holds the metrics the client exports, if it is asked to.
+type clientMetrics struct {
+	registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	bytesIn  *prometheus.CounterVec
+	bytesOut *prometheus.CounterVec
+}
+
+// newClientMetrics creates the metrics for the client.
+func newClientMetrics() *clientMetrics {
+
+	m := &clientMetrics{registry: prometheus.NewRegistry()}
+
+	m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_client_requests_total",
+		Help: "The number of requests handled, by tunnel and status-code.",
+	}, []string{"tunnel", "code"})
+
+	m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tunneller_client_upstream_duration_seconds",
+		Help:    "The time taken by the exposed service to reply, by tunnel.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tunnel"})
+
+	m.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_client_upstream_errors_total",
+		Help: "The number of failed requests to the exposed service, by tunnel and reason.",
+	}, []string{"tunnel", "reason"})
+
+	m.bytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_client_request_bytes_total",
+		Help: "The size of the requests received from the server, by tunnel.",
+	}, []string{"tunnel"})
+
+	m.bytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunneller_client_response_bytes_total",
+		Help: "The size of the responses sent to the server, by tunnel.",
+	}, []string{"tunnel"})
+
+	m.registry.MustRegister(
+		m.requests, m.latency, m.errors, m.bytesIn, m.bytesOut,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler returns the handler which serves our metrics.
+func (m *clientMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observe records a request made to the service exposed by the named
+// tunnel, which took the given time.
+//
+// If the request failed we record why, based upon the status-code of
+// the error-page we returned.
+func (m *clientMetrics) observe(tunnel string, status int, failed bool, duration time.Duration, in int, out int) {
+	if m == nil {
+		return
+	}
+
+	m.requests.WithLabelValues(tunnel, strconv.Itoa(status)).Inc()
+	m.latency.WithLabelValues(tunnel).Observe(duration.Seconds())
+	m.bytesIn.WithLabelValues(tunnel).Add(float64(in))
+	m.bytesOut.WithLabelValues(tunnel).Add(float64(out))
+
+	if failed {
+		reason := "invalid-response"
+		switch status {
+		case http.StatusBadRequest:
+			reason = "invalid-request"
+		case http.StatusServiceUnavailable:
+			reason = "connect"
+		case http.StatusGatewayTimeout:
+			reason = "timeout"
+		}
+		m.errors.WithLabelValues(tunnel, reason).Inc()
+	}
+}
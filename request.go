@@ -1,5 +1,126 @@
 package main
 
+import "fmt"
+
+// ProtocolVersion is the version of the protocol spoken between the client
+// and the server.
+//
+// This must be incremented whenever an incompatible change is made to
+// the structures in this file, or to the way in which they're used.
+//
+// Version 1 was the original protocol, which sent the request and the
+// reply as strings upon a single shared topic.
+const ProtocolVersion = 2
+
+// capabilities holds the optional features which we support.
+//
+// These are announced to our peer in our Hello message, and currently
+// consist of the compression algorithms we support.
+var capabilities = encodings
+
+// Hello is published by both the server and the client when they connect
+// to the message-bus, to announce the protocol they speak.
+//
+// The messages are retained by the broker, so that a peer which connects
+// later will still receive them.  Both configure a "will" message upon the
+// same topic, with a State of "offline", so that their announcement is
+// replaced when they go away.  The server announces a State of "stopping"
+// while it is shutting down.
+type Hello struct {
+	// State is the state of the sender, either "online", "stopping",
+	// or "offline".
+	State string
+
+	// Version is the protocol version the sender speaks.
+	Version int
+
+	// Capabilities is the list of optional features the sender supports.
+	Capabilities []string
+
+	// Software is the version of tunneller the sender is running.
+	Software string
+
+	// Tunnels lists the tunnels a client exposes.  If it is empty the
+	// client exposes a single tunnel, named after the topic the hello
+	// was published upon.
+	Tunnels []TunnelInfo `json:",omitempty"`
+}
+
+// TunnelInfo describes a tunnel which a client exposes.
+type TunnelInfo struct {
+	// Name is the name the tunnel is accessed via.
+	Name string
+
+	// Forwarded is the set of forwarding headers the server should
+	// add to the requests it sends: "all", "x-forwarded", "forwarded",
+	// or "none".  If it is empty they're all added.
+	Forwarded string `json:",omitempty"`
+
+	// Allow and Deny hold the networks, as addresses or CIDR ranges,
+	// which visitors may, and may not, make requests from.  If Allow
+	// is empty all visitors who aren't denied are allowed.
+	Allow []string `json:",omitempty"`
+	Deny  []string `json:",omitempty"`
+
+	// Users maps the names of the users who may make requests to the
+	// bcrypt hashes of their passwords.  If it is empty anybody may.
+	Users map[string]string `json:",omitempty"`
+}
+
+// tunnel returns the description of the named tunnel, which the sender
+// of the Hello exposes.
+//
+// If the sender didn't describe its tunnels, or the named tunnel, we
+// return an empty description.
+func (h Hello) tunnel(name string) TunnelInfo {
+	for _, ent := range h.Tunnels {
+		if ent.Name == name {
+			return ent
+		}
+	}
+	return TunnelInfo{Name: name}
+}
+
+// The states which may be announced in a Hello message.
+const (
+	stateOnline   = "online"
+	stateStopping = "stopping"
+	stateOffline  = "offline"
+)
+
+// newHello returns the Hello message describing ourselves, in the given
+// state.
+//
+// Any extra capabilities given are announced along with our standard ones.
+func newHello(state string, extra ...string) Hello {
+	return Hello{
+		State:        state,
+		Version:      ProtocolVersion,
+		Capabilities: append(append([]string{}, capabilities...), extra...),
+		Software:     version,
+	}
+}
+
+// compatible returns an error if the given protocol version, received
+// from a peer, is not one we can communicate with.
+func compatible(peer int) error {
+	if peer != ProtocolVersion {
+		return fmt.Errorf("incompatible protocol versions: the peer speaks version %d, we speak version %d", peer, ProtocolVersion)
+	}
+	return nil
+}
+
+// hasCapability returns true if the given list of capabilities contains
+// the named one.
+func hasCapability(list []string, name string) bool {
+	for _, ent := range list {
+		if ent == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Request is used for the communication between the client and the
 // server.
 //
@@ -10,24 +131,107 @@ package main
 // instance of the request-object down the queue.  This structure contains
 // the actual request to send:
 //
-//   GET / HTTP/1.0
-//   Host: blah.tunnel.steve.fi
-//   ...
+//	GET / HTTP/1.0
+//	Host: blah.tunnel.steve.fi
+//	...
 //
-// As well as that we also send some extra data, currently that is just
-// the source IP that made the request for tracking purposes.
+// As well as that we also send some extra data, currently that is the
+// source IP that made the request for tracking purposes, and a unique ID
+// which tells the client where to publish its reply.
 //
+// The request is held as a byte-slice, which is base64-encoded when the
+// structure is converted to JSON, so that binary bodies are not mangled.
 type Request struct {
+	// Version is the protocol version of the sender.
+	Version int
+
+	// ID is the unique identifier of this request.
+	//
+	// The client publishes its reply to the response-topic which
+	// contains this ID.
+	ID string
+
 	// Request holds the literal HTTP-request which was received
 	// by the server and which is to be proxied to the local port.
-	Request string
+	Request []byte
+
+	// Encoding is the compression algorithm which was applied to
+	// the request, if any.
+	Encoding string `json:",omitempty"`
 
 	// Source contains the IP-address of the client which actually
 	// made the request.
 	Source string
 
+	// RequestID is the value of the request's X-Request-ID header,
+	// which we either received from the visitor or assigned.
+	RequestID string `json:",omitempty"`
+
+	// Trace holds the W3C trace-context of the request, if it is
+	// being traced, i.e. its "traceparent" and "tracestate".
+	Trace map[string]string `json:",omitempty"`
+
 	// Response is the response the client sent.
-	// This is only available in the client, but it is exposed here
-	// because it does no harm.
-	Response string
+	//
+	// This is only used within the client, for display purposes,
+	// it is never sent upon the wire.
+	Response []byte `json:"-"`
+}
+
+// Response is sent by the client to the server, in reply to a Request.
+//
+// Like the request the reply is held as a byte-slice, such that binary
+// content is transferred intact.
+type Response struct {
+	// Version is the protocol version of the sender.
+	Version int
+
+	// ID is the identifier of the request this is a reply to.
+	ID string
+
+	// Response holds the literal HTTP-response which was received
+	// from the local service.
+	Response []byte
+
+	// Encoding is the compression algorithm which was applied to
+	// the response, if any.
+	Encoding string `json:",omitempty"`
+
+	// Error is set if the client could not process the request,
+	// for example because it speaks an incompatible protocol version.
+	Error string `json:",omitempty"`
+}
+
+// Event is sent by the server to a client, to tell it about something
+// which happened to one of its tunnels.
+//
+// Currently the only event reports the number of requests which were
+// rejected before they were sent to the client.
+type Event struct {
+	// Version is the protocol version of the sender.
+	Version int
+
+	// Type is the type of the event.
+	Type string
+
+	// Reason is the reason the requests were rejected; either because
+	// of the tunnel's access-lists, the server's access-lists, or its
+	// rate-limit.
+	Reason string `json:",omitempty"`
+
+	// Count is the number of requests which were rejected, since the
+	// previous event.
+	Count int `json:",omitempty"`
 }
+
+// The types of event the server sends.
+const (
+	eventRejected = "rejected"
+)
+
+// The reasons for which a request may be rejected.
+const (
+	rejectTunnel    = "tunnel-access-list"
+	rejectServer    = "server-access-list"
+	rejectRateLimit = "rate-limit"
+)
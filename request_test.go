@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestEnvelopeRoundTrip tests that our messages survive conversion to,
+// and from, JSON, with binary contents intact.
+func TestEnvelopeRoundTrip(t *testing.T) {
+
+	binary := []byte{0x00, 0xff, 0xfe, '\n', '\r', '"', '\\', 0x80, 0x7f}
+
+	tests := []struct {
+		name string
+		in   interface{}
+		out  interface{}
+	}{
+		{
+			name: "request",
+			in: &Request{
+				Version:   ProtocolVersion,
+				ID:        "1234",
+				Request:   append([]byte("POST / HTTP/1.1\r\nHost: foo\r\n\r\n"), binary...),
+				Encoding:  encodingGzip,
+				Source:    "2001:db8::1",
+				RequestID: "abcd",
+				Trace:     map[string]string{"traceparent": "00-01-02-01"},
+			},
+			out: &Request{},
+		},
+		{
+			name: "response",
+			in: &Response{
+				Version:  ProtocolVersion,
+				ID:       "1234",
+				Response: append([]byte("HTTP/1.1 200 OK\r\n\r\n"), binary...),
+				Encoding: encodingZstd,
+			},
+			out: &Response{},
+		},
+		{
+			name: "error",
+			in:   &Response{Version: ProtocolVersion, ID: "1234", Error: "failed"},
+			out:  &Response{},
+		},
+		{
+			name: "hello",
+			in: &Hello{
+				State:        stateOnline,
+				Version:      ProtocolVersion,
+				Capabilities: []string{encodingZstd},
+				Software:     "1.2.3",
+				Tunnels: []TunnelInfo{
+					{Name: "foo", Forwarded: forwardedX, Allow: []string{"10.0.0.0/8"}},
+				},
+			},
+			out: &Hello{},
+		},
+		{
+			name: "event",
+			in:   &Event{Version: ProtocolVersion, Type: eventRejected, Reason: rejectRateLimit, Count: 3},
+			out:  &Event{},
+		},
+	}
+
+	for _, tst := range tests {
+		data, err := json.Marshal(tst.in)
+		if err != nil {
+			t.Errorf("%s: failed to marshal: %s", tst.name, err)
+			continue
+		}
+		if err = json.Unmarshal(data, tst.out); err != nil {
+			t.Errorf("%s: failed to unmarshal: %s", tst.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tst.in, tst.out) {
+			t.Errorf("%s: got %+v, expected %+v", tst.name, tst.out, tst.in)
+		}
+	}
+}
+
+// TestResponseNotSent tests that the response a client records, for
+// display, isn't sent upon the wire.
+func TestResponseNotSent(t *testing.T) {
+
+	data, err := json.Marshal(Request{ID: "1234", Response: []byte("secret")})
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+
+	var out map[string]interface{}
+	if err = json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("failed to unmarshal: %s", err)
+	}
+	if _, found := out["Response"]; found {
+		t.Errorf("the response was sent: %s", data)
+	}
+}
+
+// TestCompatible tests the protocol versions we accept from our peers.
+func TestCompatible(t *testing.T) {
+
+	tests := []struct {
+		version int
+		valid   bool
+	}{
+		{ProtocolVersion, true},
+		{0, false},
+		{1, false},
+		{ProtocolVersion + 1, false},
+	}
+
+	for _, tst := range tests {
+		err := compatible(tst.version)
+		if (err == nil) != tst.valid {
+			t.Errorf("compatible(%d) gave %v, expected valid=%v", tst.version, err, tst.valid)
+		}
+	}
+}
+
+// TestHelloTunnel tests finding the description of a tunnel within an
+// announcement.
+func TestHelloTunnel(t *testing.T) {
+
+	hello := Hello{Tunnels: []TunnelInfo{
+		{Name: "foo", Forwarded: forwardedNone},
+		{Name: "bar", Deny: []string{"1.2.3.4"}},
+	}}
+
+	tests := []struct {
+		name     string
+		expected TunnelInfo
+	}{
+		{"foo", TunnelInfo{Name: "foo", Forwarded: forwardedNone}},
+		{"bar", TunnelInfo{Name: "bar", Deny: []string{"1.2.3.4"}}},
+		{"baz", TunnelInfo{Name: "baz"}},
+	}
+
+	for _, tst := range tests {
+		if out := hello.tunnel(tst.name); !reflect.DeepEqual(out, tst.expected) {
+			t.Errorf("tunnel(%q) gave %+v, expected %+v", tst.name, out, tst.expected)
+		}
+	}
+}
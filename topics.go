@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The layout of the topics we use upon the message-bus.
+//
+// Each client has a name, and all traffic relating to it lives beneath
+// a topic named after it:
+//
+//   <prefix>/<name>/hello      - The client's (retained) Hello message.
+//   <prefix>/<name>/req        - Requests sent from the server to the client.
+//   <prefix>/<name>/resp/<id>  - The reply to the request with the given ID.
+//   <prefix>/<name>/events     - Events sent from the server to the client.
+//
+// The server announces itself upon "<prefix>/_server/hello".  Names
+// beginning with "_" are reserved, so this cannot clash with a client.
+//
+// The prefix defaults to "clients", but it may be changed so that several
+// deployments can share a single broker.
+//
+
+// defaultTopicPrefix is the prefix used for our topics, unless another
+// is specified.
+const defaultTopicPrefix = "clients"
+
+// serverName is the reserved name beneath which the server publishes.
+const serverName = "_server"
+
+// helloTopic returns the topic upon which the named client, or the
+// server, announces itself.
+func helloTopic(prefix string, name string) string {
+	return prefix + "/" + name + "/hello"
+}
+
+// helloWildcard returns a topic-filter which matches the announcements
+// of all clients, and the server.
+func helloWildcard(prefix string) string {
+	return prefix + "/+/hello"
+}
+
+// helloName returns the name of the client which published upon the
+// given hello-topic.
+func helloName(topic string) string {
+	parts := strings.Split(topic, "/")
+	return parts[len(parts)-2]
+}
+
+// requestTopic returns the topic upon which the named client receives
+// requests.
+func requestTopic(prefix string, name string) string {
+	return prefix + "/" + name + "/req"
+}
+
+// eventsTopic returns the topic upon which the named client receives
+// events from the server.
+func eventsTopic(prefix string, name string) string {
+	return prefix + "/" + name + "/events"
+}
+
+// responseTopic returns the topic upon which the named client should
+// publish its reply to the request with the given ID.
+func responseTopic(prefix string, name string, id string) string {
+	return prefix + "/" + name + "/resp/" + id
+}
+
+// responseTopicFor returns true if the given topic is a response-topic
+// belonging to the named client.
+func responseTopicFor(prefix string, name string, topic string) bool {
+	return topicMatches(prefix+"/"+name+"/resp/+", topic)
+}
+
+// responseWildcard returns a topic-filter which matches the replies
+// from all clients.
+func responseWildcard(prefix string) string {
+	return prefix + "/+/resp/+"
+}
+
+// responseID returns the request ID from the given response-topic.
+func responseID(topic string) string {
+	return topic[strings.LastIndex(topic, "/")+1:]
+}
+
+// validTopicName ensures that the given client-name is safe to use as
+// part of a topic.
+//
+// Names are taken from the hostname of incoming HTTP-requests, so we must
+// make sure that they don't contain any of the MQTT wildcards, or a
+// separator which would let them escape their own topic.
+func validTopicName(name string) error {
+	if name == "" {
+		return fmt.Errorf("the name is empty")
+	}
+	if strings.ContainsAny(name, "+#/") {
+		return fmt.Errorf("the name '%s' contains a reserved character", name)
+	}
+	if strings.HasPrefix(name, "_") {
+		return fmt.Errorf("names beginning with '_' are reserved")
+	}
+	return nil
+}
+
+// validTopicPrefix ensures that the given prefix is safe to use for our
+// topics.
+//
+// Unlike a client-name a prefix may contain "/", for example "acme/dev".
+func validTopicPrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("the topic-prefix is empty")
+	}
+	if strings.ContainsAny(prefix, "+#") {
+		return fmt.Errorf("the topic-prefix '%s' contains a wildcard", prefix)
+	}
+	return nil
+}
+
+// topicMatches returns true if the given topic matches the topic-filter,
+// which may contain the MQTT wildcards "+" and "#".
+func topicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestTopicMatches tests matching topics against topic-filters.
+func TestTopicMatches(t *testing.T) {
+
+	tests := []struct {
+		filter string
+		topic  string
+		result bool
+	}{
+		{"clients/foo/req", "clients/foo/req", true},
+		{"clients/foo/req", "clients/bar/req", false},
+		{"clients/foo/req", "clients/foo/req/extra", false},
+		{"clients/foo/req/extra", "clients/foo/req", false},
+		{"clients/+/hello", "clients/foo/hello", true},
+		{"clients/+/hello", "clients/_server/hello", true},
+		{"clients/+/hello", "clients/foo/bar/hello", false},
+		{"clients/+/resp/+", "clients/foo/resp/1234", true},
+		{"clients/+/resp/+", "clients/foo/resp", false},
+		{"clients/+/resp/+", "clients/foo/resp/1234/extra", false},
+		{"clients/#", "clients/foo/resp/1234", true},
+		{"clients/#", "clients", true},
+		{"clients/#", "other/foo", false},
+		{"#", "anything/at/all", true},
+		{"acme/dev/+/req", "acme/dev/foo/req", true},
+		{"acme/dev/+/req", "acme/prod/foo/req", false},
+	}
+
+	for _, tst := range tests {
+		if out := topicMatches(tst.filter, tst.topic); out != tst.result {
+			t.Errorf("topicMatches(%q, %q) gave %v, expected %v", tst.filter, tst.topic, out, tst.result)
+		}
+	}
+}
+
+// TestValidTopicName tests the names which may be used within topics.
+func TestValidTopicName(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"foo", true},
+		{"foo-bar", true},
+		{"foo.example.com", true},
+		{"", false},
+		{"foo/bar", false},
+		{"foo+", false},
+		{"#", false},
+		{"_server", false},
+		{"_other", false},
+	}
+
+	for _, tst := range tests {
+		err := validTopicName(tst.name)
+		if (err == nil) != tst.valid {
+			t.Errorf("validTopicName(%q) gave %v, expected valid=%v", tst.name, err, tst.valid)
+		}
+	}
+}
+
+// TestValidTopicPrefix tests the prefixes which may be used for topics.
+func TestValidTopicPrefix(t *testing.T) {
+
+	tests := []struct {
+		prefix string
+		valid  bool
+	}{
+		{"clients", true},
+		{"acme/dev", true},
+		{"", false},
+		{"clients/+", false},
+		{"clients/#", false},
+	}
+
+	for _, tst := range tests {
+		err := validTopicPrefix(tst.prefix)
+		if (err == nil) != tst.valid {
+			t.Errorf("validTopicPrefix(%q) gave %v, expected valid=%v", tst.prefix, err, tst.valid)
+		}
+	}
+}
+
+// TestResponseTopics tests building, and parsing, response-topics.
+func TestResponseTopics(t *testing.T) {
+
+	tests := []struct {
+		prefix string
+		name   string
+		id     string
+	}{
+		{"clients", "foo", "1234"},
+		{"acme/dev", "foo", "abcd-ef"},
+	}
+
+	for _, tst := range tests {
+		topic := responseTopic(tst.prefix, tst.name, tst.id)
+		if !topicMatches(responseWildcard(tst.prefix), topic) {
+			t.Errorf("%s doesn't match the response wildcard", topic)
+		}
+		if !responseTopicFor(tst.prefix, tst.name, topic) {
+			t.Errorf("%s isn't a response-topic of %s", topic, tst.name)
+		}
+		if responseTopicFor(tst.prefix, "other", topic) {
+			t.Errorf("%s is a response-topic of other", topic)
+		}
+		if id := responseID(topic); id != tst.id {
+			t.Errorf("responseID(%q) gave %q, expected %q", topic, id, tst.id)
+		}
+		if name := helloName(helloTopic(tst.prefix, tst.name)); name != tst.name {
+			t.Errorf("helloName gave %q, expected %q", name, tst.name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing.
+//
+// If given the address of an OpenTelemetry collector, via -otlp-endpoint,
+// both the server and the client record spans for each request and export
+// them via OTLP over HTTP:
+//
+//	server: receive -> publish ... relay
+//	client:              receive -> upstream
+//
+// The W3C trace-context is carried from the server to the client within
+// the Request, and injected into the request made to the upstream, so the
+// whole journey of a request appears within a single trace.  If the
+// visitor sent a "traceparent" header we continue their trace.
+//
+// Without an endpoint the spans are discarded.
+//
+
+// tracerName is the name of our tracer.
+const tracerName = "github.com/skx/tunneller"
+
+// tracer returns our tracer.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// propagator returns the propagator we use to carry the trace-context
+// between the visitor, the server, the client, and the upstream.
+func propagator() propagation.TextMapPropagator {
+	return propagation.TraceContext{}
+}
+
+// setupTracing configures the export of our spans to the collector at
+// the given endpoint, e.g. "http://localhost:4318".
+//
+// Errors encountered when exporting are sent to the given logger.  The
+// returned function flushes any pending spans, and must be called before
+// we exit.
+func setupTracing(endpoint string, service string, log *slog.Logger) (func(), error) {
+
+	if endpoint == "" {
+		return func() {}, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", service),
+			attribute.String("service.version", version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn("failed to export spans", "error", err)
+	}))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		provider.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tunnel is a single service which the client exposes, under a name.
+//
+// A client may expose several services over its single connection to
+// the message-bus, each with its own name and statistics.
+type tunnel struct {
+	// name is the name the service is accessed via.
+	name string
+
+	// upstream is the service we're exposing.
+	upstream *upstream
+
+	// stats holds the HTTP-status-codes we've returned, and their count.
+	stats map[string]int
+
+	// requests holds the recent requests we've seen.
+	requests []Request
+
+	// lock protects our statistics and recent requests, which are
+	// updated as requests are handled, and read by the GUI.
+	lock sync.Mutex
+
+	// traffic holds the volume of traffic we've exchanged with the
+	// server for this tunnel.
+	traffic trafficStats
+
+	// opts holds the options we announce to the server.
+	opts tunnelOptions
+
+	// users holds the users who may make requests, if any, with the
+	// bcrypt hashes of their passwords.
+	users map[string]string
+}
+
+// tunnelOptions holds the options of a tunnel which are announced to the
+// server, for it to apply to the requests it sends us.
+type tunnelOptions struct {
+	// forwarded is the set of forwarding headers the server adds.
+	forwarded string
+
+	// allow and deny hold the networks visitors may, and may not,
+	// make requests from.  Each may be an address, a CIDR range, or
+	// the path to a file containing them.
+	allow []string
+	deny  []string
+
+	// auth holds the users who may make requests, as "user:password",
+	// and htpasswd is the path to a file containing more of them.
+	auth     []string
+	htpasswd string
+}
+
+// maxRecentRequests is the number of recent requests we keep, for each
+// tunnel, for display in the GUI.
+const maxRecentRequests = 5
+
+// newTunnel creates a tunnel exposing the given service under the given
+// name.
+func newTunnel(name string, expose string, upOpts upstreamOptions, opts tunnelOptions) (*tunnel, error) {
+
+	if err := validTopicName(name); err != nil {
+		return nil, err
+	}
+	if err := validForwarded(opts.forwarded); err != nil {
+		return nil, err
+	}
+
+	//
+	// Replace any files in our access-lists with their contents.
+	//
+	var err error
+	if opts.allow, err = expandNetworks(opts.allow); err != nil {
+		return nil, err
+	}
+	if opts.deny, err = expandNetworks(opts.deny); err != nil {
+		return nil, err
+	}
+
+	//
+	// Hash the passwords of our users, and add those from our
+	// htpasswd file.
+	//
+	users, err := hashPasswords(opts.auth)
+	if err != nil {
+		return nil, err
+	}
+	if opts.htpasswd != "" {
+		more, htErr := loadHtpasswd(opts.htpasswd)
+		if htErr != nil {
+			return nil, htErr
+		}
+		for user, hash := range more {
+			users[user] = hash
+		}
+	}
+
+	up, err := newUpstream(expose, upOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup %s: %s", expose, err.Error())
+	}
+
+	return &tunnel{
+		name:     name,
+		upstream: up,
+		stats:    make(map[string]int),
+		opts:     opts,
+		users:    users,
+	}, nil
+}
+
+// info returns the description of the tunnel we announce to the server.
+func (t *tunnel) info() TunnelInfo {
+	return TunnelInfo{
+		Name:      t.name,
+		Forwarded: t.opts.forwarded,
+		Allow:     t.opts.allow,
+		Deny:      t.opts.deny,
+		Users:     t.users,
+	}
+}
+
+// record records the given request, which received a response with the
+// given status-code.
+func (t *tunnel) record(req Request, status int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.stats[strconv.Itoa(status)]++
+
+	//
+	// Add this request to our list of "recent requests", and
+	// truncate the list, so that we don't consume all our RAM
+	// keeping everything.
+	//
+	t.requests = append(t.requests, req)
+	if len(t.requests) > maxRecentRequests {
+		t.requests = t.requests[len(t.requests)-maxRecentRequests:]
+	}
+}
+
+// snapshot returns the status-codes we've seen, in order, along with
+// their counts, and a copy of our recent requests.
+func (t *tunnel) snapshot() ([]string, []float64, []Request) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var codes []string
+	for code := range t.stats {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	var counts []float64
+	for _, code := range codes {
+		counts = append(counts, float64(t.stats[code]))
+	}
+
+	return codes, counts, append([]Request{}, t.requests...)
+}
+
+// stringList holds the values of a repeatable flag, such as -expose.
+type stringList []string
+
+// String returns the values of the flag.
+func (e *stringList) String() string {
+	return strings.Join(*e, ",")
+}
+
+// Set adds a value to the flag.
+func (e *stringList) Set(value string) error {
+	*e = append(*e, value)
+	return nil
+}
+
+// splitExpose splits an -expose value into its name and service.
+//
+// The value is either "name=service", or just "service" in which case
+// the name returned is empty.
+func splitExpose(value string) (string, string) {
+	i := strings.Index(value, "=")
+	if i <= 0 || strings.ContainsAny(value[:i], ":/") {
+		return "", value
+	}
+	return value[:i], value[i+1:]
+}
+
+// trafficStats records the volume of the HTTP-traffic we've received
+// and sent, before and after compression.
+type trafficStats struct {
+	sync.Mutex
+
+	// requestRaw and requestWire hold the size of the requests we've
+	// received, after and before decompression.
+	requestRaw  int64
+	requestWire int64
+
+	// responseRaw and responseWire hold the size of the responses
+	// we've sent, before and after compression.
+	responseRaw  int64
+	responseWire int64
+
+	// rejected holds the number of requests the server rejected
+	// before sending them to us, keyed by the reason.
+	rejected map[string]int64
+}
+
+// addRejected records the rejection of the given number of requests by
+// the server.
+func (t *trafficStats) addRejected(reason string, count int) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.rejected == nil {
+		t.rejected = make(map[string]int64)
+	}
+	t.rejected[reason] += int64(count)
+}
+
+// addRequest records the receipt of a request.
+func (t *trafficStats) addRequest(raw int, wire int) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.requestRaw += int64(raw)
+	t.requestWire += int64(wire)
+}
+
+// addResponse records the sending of a response.
+func (t *trafficStats) addResponse(raw int, wire int) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.responseRaw += int64(raw)
+	t.responseWire += int64(wire)
+}
+
+// String returns a human-readable summary of our traffic, suitable for
+// display in the GUI.
+func (t *trafficStats) String() string {
+	t.Lock()
+	defer t.Unlock()
+
+	ratio := func(raw int64, wire int64) string {
+		if raw == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", float64(wire)*100/float64(raw))
+	}
+
+	out := fmt.Sprintf("\n  Requests:  %d bytes, %d bytes compressed (%s)\n",
+		t.requestRaw, t.requestWire, ratio(t.requestRaw, t.requestWire))
+	out += fmt.Sprintf("  Responses: %d bytes, %d bytes compressed (%s)\n",
+		t.responseRaw, t.responseWire, ratio(t.responseRaw, t.responseWire))
+
+	var total int64
+	var reasons []string
+	for reason, count := range t.rejected {
+		total += count
+		reasons = append(reasons, fmt.Sprintf("%d by %s", count, reason))
+	}
+	sort.Strings(reasons)
+	out += fmt.Sprintf("  Rejected:  %d requests", total)
+	if len(reasons) > 0 {
+		out += " (" + strings.Join(reasons, ", ") + ")"
+	}
+	return out + "\n"
+}
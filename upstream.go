@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// upstream is the local service which the client exposes.
+//
+// Requests received from the server are parsed, and sent to the service
+// via a pooled HTTP-transport, so that connections are reused and the
+// responses are framed correctly regardless of whether the service uses
+// keep-alive, or chunked-encoding.
+//
+// The service may be specified as either "host:port", as a URL such
+// as "https://localhost:8443" if it only accepts TLS, or as the path to
+// a Unix domain socket such as "unix:/run/app.sock".
+type upstream struct {
+	// scheme is either "http" or "https".
+	scheme string
+
+	// address is the host:port of the service.
+	address string
+
+	// socket is the path to the Unix domain socket the service is
+	// listening upon, if any.
+	socket string
+
+	// timeout is the maximum time we'll wait for a complete response.
+	timeout time.Duration
+
+	// transport is used to make our requests.
+	transport *http.Transport
+}
+
+// upstreamOptions holds the options for connecting to the service.
+type upstreamOptions struct {
+	// timeout is the maximum time we'll wait for a complete response.
+	timeout time.Duration
+
+	// insecure disables the verification of the service's certificate.
+	insecure bool
+
+	// caFile is the path to a PEM-encoded CA certificate, which is
+	// used to verify the service's certificate.
+	caFile string
+
+	// serverName is the name sent via SNI, and verified against the
+	// service's certificate.
+	serverName string
+
+	// certFile and keyFile are the paths to a PEM-encoded client
+	// certificate, and its key, to present to the service.
+	certFile string
+	keyFile  string
+}
+
+// newUpstream creates an upstream for the service at the given address.
+func newUpstream(address string, opts upstreamOptions) (*upstream, error) {
+
+	u := &upstream{
+		scheme:  "http",
+		address: address,
+		timeout: opts.timeout,
+	}
+
+	//
+	// The service may be listening upon a Unix domain socket, or
+	// expressed as a URL.
+	//
+	// Requests to a Unix domain socket still need a host for the URL,
+	// but it is never used as we always dial the socket.
+	//
+	if strings.HasPrefix(address, "unix:") {
+		u.socket = strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+		u.address = "localhost"
+		if u.socket == "" {
+			return nil, fmt.Errorf("no path given for the Unix domain socket in %s", address)
+		}
+	} else if strings.Contains(address, "://") {
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported scheme '%s' in %s", parsed.Scheme, address)
+		}
+		u.scheme = parsed.Scheme
+		u.address = parsed.Host
+		if parsed.Port() == "" {
+			u.address = net.JoinHostPort(parsed.Hostname(), map[string]string{"http": "80", "https": "443"}[u.scheme])
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dial := dialer.DialContext
+	if u.socket != "" {
+		dial = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", u.socket)
+		}
+	}
+
+	u.transport = &http.Transport{
+		DialContext:         dial,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+
+		// We must pass the response to the visitor
+		// exactly as we received it.
+		DisableCompression: true,
+	}
+	return u, nil
+}
+
+// String returns a description of the service, for display to the user.
+func (u *upstream) String() string {
+	if u.socket != "" {
+		return "the Unix domain socket " + u.socket
+	}
+	return u.scheme + "://" + u.address
+}
+
+// tlsConfig returns the TLS configuration for connecting to the service.
+func (o upstreamOptions) tlsConfig() (*tls.Config, error) {
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: o.insecure,
+		ServerName:         o.serverName,
+	}
+
+	if o.caFile != "" {
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.caFile)
+		}
+	}
+
+	if o.certFile != "" || o.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// fetch makes the given (literal) HTTP-request to the service, returning
+// the literal response and its status-code.
+//
+// If the service cannot be reached, or doesn't reply in time, then an
+// error-page is returned instead, along with the error for display to
+// the user.  (The visitor is not shown the details.)
+//
+// The request is traced as a child of the span in the given context.
+func (u *upstream) fetch(ctx context.Context, raw []byte) ([]byte, int, error) {
+
+	ctx, span := tracer().Start(ctx, "tunneller.client.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("server.address", u.address)))
+	defer span.End()
+
+	out, status, err := u.do(ctx, raw)
+
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	return out, status, err
+}
+
+// do makes the given (literal) HTTP-request to the service, carrying the
+// trace-context from the given context, as described for fetch.
+func (u *upstream) do(ctx context.Context, raw []byte) ([]byte, int, error) {
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		page, status := errorPage(http.StatusBadRequest, "The request could not be parsed.")
+		return page, status, err
+	}
+	propagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	//
+	// The request is addressed to us, so we need to point it at the
+	// service.  The Host: header is left unchanged.
+	//
+	req.RequestURI = ""
+	req.URL.Scheme = u.scheme
+	req.URL.Host = u.address
+
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	res, err := u.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			page, status := errorPage(http.StatusGatewayTimeout, fmt.Sprintf("The remote server didn't reply within %s.", u.timeout))
+			return page, status, err
+		}
+		page, status := errorPage(http.StatusServiceUnavailable, "The remote server was unreachable.")
+		return page, status, err
+	}
+	defer res.Body.Close()
+
+	out, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			page, status := errorPage(http.StatusGatewayTimeout, fmt.Sprintf("The remote server didn't complete its reply within %s.", u.timeout))
+			return page, status, err
+		}
+		page, status := errorPage(http.StatusBadGateway, "The reply from the remote server could not be read.")
+		return page, status, err
+	}
+	return out, res.StatusCode, nil
+}
+
+// errorPage returns a literal HTTP-response containing the given message,
+// and its status-code.
+func errorPage(status int, message string) ([]byte, int) {
+	page := fmt.Sprintf(`HTTP/1.0 %d %s
+Content-type: text/html; charset=UTF-8
+Connection: close
+
+<!DOCTYPE html>
+<html>
+<body>
+<p>%s</p>
+</body>
+</html>`, status, http.StatusText(status), html.EscapeString(message))
+
+	return []byte(page), status
+}
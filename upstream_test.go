@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUpstreamDo tests proxying literal requests to a service, and the
+// literal responses we return.
+func TestUpstreamDo(t *testing.T) {
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		case "/chunked":
+			w.(http.Flusher).Flush()
+			fmt.Fprintf(w, "chunk one, ")
+			w.(http.Flusher).Flush()
+			fmt.Fprintf(w, "chunk two")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Seen-Host", r.Host)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+	}))
+	defer service.Close()
+
+	address := strings.TrimPrefix(service.URL, "http://")
+
+	//
+	// Find an address upon which nothing is listening.
+	//
+	closed := httptest.NewServer(http.NotFoundHandler())
+	unreachable := strings.TrimPrefix(closed.URL, "http://")
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		address string
+		request string
+		status  int
+		body    string
+		host    string
+		failed  bool
+	}{
+		{
+			name:    "get",
+			address: address,
+			request: "GET /path?q=1 HTTP/1.1\r\nHost: foo.example.com\r\n\r\n",
+			status:  http.StatusOK,
+			body:    "GET /path?q=1 ",
+			host:    "foo.example.com",
+		},
+		{
+			name:    "post",
+			address: address,
+			request: "POST /submit HTTP/1.1\r\nHost: foo.example.com\r\nContent-Length: 5\r\n\r\nhello",
+			status:  http.StatusOK,
+			body:    "POST /submit hello",
+			host:    "foo.example.com",
+		},
+		{
+			name:    "chunked-request",
+			address: address,
+			request: "POST /submit HTTP/1.1\r\nHost: foo.example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			status:  http.StatusOK,
+			body:    "POST /submit hello",
+			host:    "foo.example.com",
+		},
+		{
+			name:    "chunked-response",
+			address: address,
+			request: "GET /chunked HTTP/1.1\r\nHost: foo.example.com\r\n\r\n",
+			status:  http.StatusOK,
+			body:    "chunk one, chunk two",
+		},
+		{
+			name:    "unparseable",
+			address: address,
+			request: "nonsense\r\n\r\n",
+			status:  http.StatusBadRequest,
+			failed:  true,
+		},
+		{
+			name:    "unreachable",
+			address: unreachable,
+			request: "GET / HTTP/1.1\r\nHost: foo.example.com\r\n\r\n",
+			status:  http.StatusServiceUnavailable,
+			failed:  true,
+		},
+		{
+			name:    "timeout",
+			address: address,
+			request: "GET /slow HTTP/1.1\r\nHost: foo.example.com\r\n\r\n",
+			status:  http.StatusGatewayTimeout,
+			failed:  true,
+		},
+	}
+
+	for _, tst := range tests {
+		u, err := newUpstream(tst.address, upstreamOptions{timeout: 250 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("%s: failed to create the upstream: %s", tst.name, err)
+		}
+
+		out, status, err := u.do(context.Background(), []byte(tst.request))
+		if (err != nil) != tst.failed {
+			t.Errorf("%s: gave error %v, expected failure=%v", tst.name, err, tst.failed)
+		}
+		if status != tst.status {
+			t.Errorf("%s: gave status %d, expected %d", tst.name, status, tst.status)
+		}
+
+		//
+		// Whatever happened the result must be a response we can
+		// parse, with the status we were given.
+		//
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(out)), nil)
+		if err != nil {
+			t.Errorf("%s: failed to parse the response: %s", tst.name, err)
+			continue
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Errorf("%s: failed to read the body: %s", tst.name, err)
+			continue
+		}
+		if res.StatusCode != tst.status {
+			t.Errorf("%s: the response had status %d, expected %d", tst.name, res.StatusCode, tst.status)
+		}
+		if tst.body != "" && string(body) != tst.body {
+			t.Errorf("%s: the body was %q, expected %q", tst.name, body, tst.body)
+		}
+		if tst.host != "" && res.Header.Get("X-Seen-Host") != tst.host {
+			t.Errorf("%s: the service saw the host %q, expected %q", tst.name, res.Header.Get("X-Seen-Host"), tst.host)
+		}
+	}
+}
+
+// TestErrorPage tests that our error-pages are valid, escaped, responses.
+func TestErrorPage(t *testing.T) {
+
+	page, status := errorPage(http.StatusBadGateway, "<script>")
+	if status != http.StatusBadGateway {
+		t.Errorf("errorPage gave status %d", status)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(page)), nil)
+	if err != nil {
+		t.Fatalf("failed to parse the error-page: %s", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("the error-page had status %d", res.StatusCode)
+	}
+	if strings.Contains(string(body), "<script>") || !strings.Contains(string(body), "&lt;script&gt;") {
+		t.Errorf("the message wasn't escaped: %s", body)
+	}
+}